@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nitintf/openport/internal/bench"
+	"github.com/nitintf/openport/internal/ui"
+)
+
+func newBenchCmd(tf *tunnelFlags) *cobra.Command {
+	var duration time.Duration
+	var concurrency int
+	var scenarios []string
+	var publicAddr string
+	var jsonOut bool
+
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Measure tunnel throughput and latency",
+		Long: "Run an echo service behind a tunnel and load it from concurrent clients, reporting requests per second " +
+			"and p50/p99 latency per scenario. Without --public, a server is started in-process; with it, " +
+			"the tunnel goes through --server and requests are sent to the given public address.\n\n" +
+			"Scenarios: direct (no tunnel, as a baseline), small, large (1 MiB bodies) and streams (256 concurrent clients).",
+		Example: `  op bench
+  op bench --duration 30s --json > bench.json
+  op bench --scenario small --concurrency 64
+  op bench --server tunnel.example.com:9090 --public tunnel.example.com:80 --token $TOKEN`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var selected []bench.Scenario
+			for _, sc := range bench.DefaultScenarios {
+				if len(scenarios) > 0 && !slices.Contains(scenarios, sc.Name) {
+					continue
+				}
+				if concurrency > 0 {
+					sc.Concurrency = concurrency
+				}
+				selected = append(selected, sc)
+			}
+			if len(selected) == 0 {
+				err := fmt.Errorf("no scenario matches %s", strings.Join(scenarios, ", "))
+				ui.PrintError(err)
+				return err
+			}
+
+			// The in-process server logs every tunnel; keep the report clean.
+			log.SetOutput(io.Discard)
+
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			report := printResult
+			if jsonOut {
+				report = nil
+			} else {
+				fmt.Println()
+				fmt.Printf("  %-8s %6s %9s %10s %12s %9s %9s %9s\n",
+					"SCENARIO", "CONC", "REQUESTS", "REQ/S", "THROUGHPUT", "P50", "P99", "ERRORS")
+			}
+
+			results, err := bench.Run(ctx, bench.Config{
+				Tunnel:     tf.config(),
+				PublicAddr: publicAddr,
+				Duration:   duration,
+				Scenarios:  selected,
+			}, report)
+			if err != nil {
+				ui.PrintError(err)
+				return err
+			}
+
+			if jsonOut {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(results)
+			}
+			fmt.Println()
+			return nil
+		},
+	}
+
+	cmd.Flags().DurationVar(&duration, "duration", 5*time.Second, "how long to run each scenario")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 0, "concurrent clients for every scenario (default per scenario)")
+	cmd.Flags().StringArrayVar(&scenarios, "scenario", nil, "run only this scenario (repeatable)")
+	cmd.Flags().StringVar(&publicAddr, "public", "", "public HTTP address of the server given by --server")
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "print results as JSON")
+	return cmd
+}
+
+func printResult(r bench.Result) {
+	fmt.Printf("  %-8s %6d %9d %10.0f %10.1fMB/s %7.2fms %7.2fms %9d\n",
+		r.Scenario, r.Concurrency, r.Requests, r.RPS, r.BytesPerSec/1e6, r.P50, r.P99, r.Errors)
+}
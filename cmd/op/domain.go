@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/ui"
+)
+
+func newDomainCmd(tf *tunnelFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "domain <domain>",
+		Short: "Show the DNS records needed to use a custom domain",
+		Long: "Print the CNAME and TXT records that point a domain you own at the openport server " +
+			"and prove it is yours. The TXT value comes from the server, which derives it from your token and the domain.",
+		Example:       `  op domain dev.example.com --server tunnel.example.com:9090 --token $TOKEN`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if tf.token == "" {
+				err := errors.New("custom domains need a token: pass --token or set OPENPORT_TOKEN")
+				ui.PrintError(err)
+				return err
+			}
+
+			domain := strings.TrimSuffix(strings.ToLower(args[0]), ".")
+			host, _, err := net.SplitHostPort(tf.serverAddr)
+			if err != nil {
+				host = tf.serverAddr
+			}
+			name, value, err := client.DomainRecord(cmd.Context(), tf.config(), domain)
+			if err != nil {
+				ui.PrintError(err)
+				return err
+			}
+
+			fmt.Println()
+			fmt.Printf("  %-6s %s  →  %s\n", "CNAME", domain, host)
+			fmt.Printf("  %-6s %s  →  %s\n", "TXT", name, value)
+			fmt.Println()
+			fmt.Printf("  Then run: op <port> --domain %s\n\n", domain)
+			return nil
+		},
+	}
+}
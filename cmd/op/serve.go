@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/nitintf/openport/internal/fileserver"
+	"github.com/nitintf/openport/internal/ui"
+)
+
+func newServeCmd(tf *tunnelFlags) *cobra.Command {
+	var spa, listing bool
+	var auth string
+
+	cmd := &cobra.Command{
+		Use:   "serve <path>",
+		Short: "Share a local directory over a tunnel",
+		Long:  "Serve a directory with a built-in file server, with range requests and optional listings. No local server needed. Dotfiles and symlinks leading out of the directory are not served.",
+		Example: `  op serve ./dist --spa
+  op serve ~/screenshots --auth me:s3cret --listing`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			root, err := filepath.Abs(args[0])
+			if err != nil {
+				ui.PrintError(err)
+				return err
+			}
+
+			opts := fileserver.Options{SPA: spa, Listing: listing}
+			if auth != "" {
+				opts.Username, opts.Password, err = fileserver.ParseCredentials(auth)
+				if err != nil {
+					ui.PrintError(err)
+					return err
+				}
+			}
+
+			handler, err := fileserver.New(root, opts)
+			if err != nil {
+				ui.PrintError(err)
+				return err
+			}
+
+			cfg := tf.config()
+			cfg.Handler = handler
+			return run(cfg, root)
+		},
+	}
+
+	cmd.Flags().BoolVar(&spa, "spa", false, "serve index.html for unknown paths (single-page apps)")
+	cmd.Flags().BoolVar(&listing, "listing", false, "list directories that have no index.html")
+	cmd.Flags().StringVar(&auth, "auth", "", "require HTTP basic auth as user:pass")
+
+	return cmd
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/tunnel"
+	"github.com/nitintf/openport/internal/ui"
+)
+
+func newTLSCmd(tf *tunnelFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "tls <port|host:port|unix://path>",
+		Short: "Expose a local TLS service without decrypting it",
+		Long: "Relay TLS connections to a local service that terminates TLS itself, for example to test mTLS. " +
+			"The server routes connections by SNI and never sees the plaintext.",
+		Example: `  op tls 8443
+  op tls 8443 --subdomain secure --domain secure.example.com`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, err := client.ParseTarget(args[0])
+			if err != nil {
+				ui.PrintError(err)
+				return err
+			}
+
+			cfg := tf.config()
+			cfg.Type = tunnel.TypeTLS
+			cfg.LocalAddr = target.Addr
+			cfg.LocalNetwork = target.Network
+			return run(cfg, "tls://"+target.Addr)
+		},
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/tunnel"
+	"github.com/nitintf/openport/internal/ui"
+)
+
+func newUDPCmd(tf *tunnelFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "udp <port|host:port>",
+		Short: "Expose a local UDP service on a public port",
+		Long: "Relay datagrams from a public UDP port allocated by the server to a local UDP service, " +
+			"such as a DNS resolver or a game server. Replies go back to the peer that sent the request.",
+		Example: `  op udp 53
+  op udp 192.168.1.20:27015`,
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			target, err := client.ParseTarget(args[0])
+			if err != nil {
+				ui.PrintError(err)
+				return err
+			}
+
+			cfg := tf.config()
+			cfg.Type = tunnel.TypeUDP
+			cfg.LocalAddr = target.Addr
+			cfg.LocalNetwork = target.Network
+			return run(cfg, "udp://"+target.Addr)
+		},
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/nitintf/openport/internal/server"
 	"github.com/nitintf/openport/internal/version"
@@ -17,6 +22,43 @@ func main() {
 	addr := flag.String("addr", "", "public HTTP address to listen on")
 	tunnelAddr := flag.String("tunnel-addr", ":9090", "address for tunnel client connections")
 	domain := flag.String("domain", "localhost", "base domain for subdomain routing")
+	adminAddr := flag.String("admin-addr", "", "address for the admin API and /metrics (disabled if empty)")
+	rateLimit := flag.Float64("rate-limit", 0, "default requests per second per tunnel (0 = unlimited)")
+	rateBurst := flag.Int("rate-burst", 0, "default request burst per tunnel")
+	maxRateLimit := flag.Float64("max-rate-limit", 0, "highest requests per second a client may ask for (defaults to -rate-limit)")
+	ipRateLimit := flag.Float64("ip-rate-limit", 0, "requests per second per source IP (0 = unlimited)")
+	ipRateBurst := flag.Int("ip-rate-burst", 0, "request burst per source IP")
+	bandwidth := flag.Int64("bandwidth", 0, "default bytes per second per tunnel (0 = unlimited)")
+	authTokens := flag.String("auth-tokens", "", "comma-separated tokens clients must present (empty allows anyone)")
+	handshakeTimeout := flag.Duration("handshake-timeout", 10*time.Second, "time a client has to complete the tunnel handshake")
+	maxTunnelsPerIP := flag.Int("max-tunnels-per-ip", 0, "concurrent tunnels per client IP (0 = unlimited)")
+	maxTunnelsPerToken := flag.Int("max-tunnels-per-token", 0, "concurrent tunnels per auth token (0 = unlimited)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "close tunnels with no traffic for this long (0 = never)")
+	maxLifetime := flag.Duration("max-lifetime", 0, "close tunnels after this long (0 = never)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "time to read public request headers")
+	readTimeout := flag.Duration("read-timeout", 0, "time to read a whole public request (0 = none)")
+	writeTimeout := flag.Duration("write-timeout", 0, "time to write a whole public response (0 = none)")
+	keepAliveTimeout := flag.Duration("keepalive-timeout", 2*time.Minute, "idle time before closing public keep-alive connections")
+	responseTimeout := flag.Duration("response-timeout", 90*time.Second, "time to wait for response headers from a tunnel (0 = none)")
+	maxRequestBody := flag.Int64("max-request-body", 0, "largest request body in bytes (0 = unlimited)")
+	maxResponseBody := flag.Int64("max-response-body", 0, "largest response body in bytes (0 = unlimited)")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated IPs or CIDRs whose X-Forwarded-* headers are trusted")
+	maxBandwidth := flag.Int64("max-bandwidth", 0, "highest bytes per second a client may ask for (defaults to -bandwidth)")
+	customDomains := flag.Bool("custom-domains", false, "let clients bind their own domains after a DNS TXT check")
+	domainKey := flag.String("domain-key", "", "secret the custom domain TXT values are derived from; keep it stable (default $DOMAIN_KEY, random if unset)")
+	dnsResolver := flag.String("dns-resolver", "", "DNS server (host:port) used to verify custom domains (default: system resolver)")
+	tlsAddr := flag.String("tls-addr", "", "HTTPS address for custom domains, with certificates issued on demand (disabled if empty)")
+	certDir := flag.String("cert-dir", "", "directory to cache issued certificates in")
+	acmeEmail := flag.String("acme-email", "", "contact email for the ACME account")
+	acmeDirectory := flag.String("acme-directory", "", "ACME directory URL (default: Let's Encrypt)")
+	tlsPassthroughAddr := flag.String("tls-passthrough-addr", "", "address for TLS tunnels, routed by SNI without decrypting (disabled if empty)")
+	udpPorts := flag.String("udp-ports", "", "public port range for UDP tunnels, e.g. 20000-20100 (disabled if empty)")
+	udpIdleTimeout := flag.Duration("udp-idle-timeout", time.Minute, "forget UDP peers after this long without traffic")
+	streamWindow := flag.Uint("stream-window", 0, "bytes a tunnel stream may have in flight toward the server (256 KiB to 16 MiB)")
+	quicAddr := flag.String("quic-addr", "", "UDP address for tunnels over QUIC, e.g. :9090 (disabled if empty)")
+	quicCert := flag.String("quic-cert", "", "certificate file for QUIC (self-signed if empty)")
+	quicKey := flag.String("quic-key", "", "key file for -quic-cert")
+	noCompression := flag.Bool("no-compression", false, "refuse clients that offer to compress bodies through the tunnel")
 	flag.Parse()
 
 	if *showVersion {
@@ -45,10 +87,72 @@ func main() {
 		*domain = env
 	}
 
+	if env := os.Getenv("AUTH_TOKENS"); env != "" && *authTokens == "" {
+		*authTokens = env
+	}
+	if env := os.Getenv("TRUSTED_PROXIES"); env != "" && *trustedProxies == "" {
+		*trustedProxies = env
+	}
+	if env := os.Getenv("DOMAIN_KEY"); env != "" && *domainKey == "" {
+		*domainKey = env
+	}
+
+	var err error
 	cfg := server.Config{
 		Addr:       *addr,
 		TunnelAddr: *tunnelAddr,
 		Domain:     *domain,
+		AdminAddr:  *adminAddr,
+
+		RateLimit:    *rateLimit,
+		RateBurst:    *rateBurst,
+		MaxRateLimit: *maxRateLimit,
+		IPRateLimit:  *ipRateLimit,
+		IPRateBurst:  *ipRateBurst,
+
+		BandwidthLimit:    *bandwidth,
+		MaxBandwidthLimit: *maxBandwidth,
+
+		AuthTokens:         splitList(*authTokens),
+		HandshakeTimeout:   *handshakeTimeout,
+		MaxTunnelsPerIP:    *maxTunnelsPerIP,
+		MaxTunnelsPerToken: *maxTunnelsPerToken,
+		IdleTimeout:        *idleTimeout,
+		MaxTunnelLifetime:  *maxLifetime,
+
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		KeepAliveTimeout:  *keepAliveTimeout,
+		ResponseTimeout:   *responseTimeout,
+		MaxRequestBody:    *maxRequestBody,
+		MaxResponseBody:   *maxResponseBody,
+
+		TrustedProxies: splitList(*trustedProxies),
+
+		CustomDomains: *customDomains,
+		DomainKey:     *domainKey,
+		TLSAddr:       *tlsAddr,
+		CertDir:       *certDir,
+		ACMEEmail:     *acmeEmail,
+		ACMEDirectory: *acmeDirectory,
+
+		TLSPassthroughAddr: *tlsPassthroughAddr,
+		UDPIdleTimeout:     *udpIdleTimeout,
+		StreamWindow:       uint32(min(*streamWindow, 1<<32-1)),
+		DisableCompression: *noCompression,
+		QUICAddr:           *quicAddr,
+		QUICCertFile:       *quicCert,
+		QUICKeyFile:        *quicKey,
+	}
+	if *udpPorts != "" {
+		cfg.UDPPortStart, cfg.UDPPortEnd, err = parsePortRange(*udpPorts)
+		if err != nil {
+			log.Fatalf("invalid -udp-ports: %v", err)
+		}
+	}
+	if *dnsResolver != "" {
+		cfg.Resolver = newResolver(*dnsResolver)
 	}
 
 	srv, err := server.New(cfg)
@@ -70,3 +174,46 @@ func main() {
 	log.Println("shutting down server...")
 	srv.Stop()
 }
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// newResolver returns a resolver that sends every query to the DNS server at
+// addr instead of the system's.
+func newResolver(addr string) *net.Resolver {
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// parsePortRange parses "start-end", or a single port.
+func parsePortRange(s string) (int, int, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("%q is not a valid port range", s)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,309 @@
+// Package bench measures tunnel throughput and latency. It runs an echo
+// service, opens a tunnel to it and drives the public side with concurrent
+// clients.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/server"
+)
+
+// Scenario is one workload.
+type Scenario struct {
+	Name        string
+	Concurrency int  // clients sending requests back to back
+	BodySize    int  // request body echoed back (0 sends a GET)
+	Direct      bool // skip the tunnel, as a baseline
+}
+
+// DefaultScenarios compare small requests with and without the tunnel, then
+// add large bodies and many concurrent streams.
+var DefaultScenarios = []Scenario{
+	{Name: "direct", Concurrency: 16, Direct: true},
+	{Name: "small", Concurrency: 16},
+	{Name: "large", Concurrency: 4, BodySize: 1 << 20},
+	{Name: "streams", Concurrency: 256},
+}
+
+// Config describes a benchmark run.
+type Config struct {
+	// Tunnel configures the client. When PublicAddr is empty a server is
+	// started in-process and ServerAddr is ignored.
+	Tunnel     client.Config
+	PublicAddr string // public HTTP address of the server under test
+
+	Duration  time.Duration // per scenario
+	Scenarios []Scenario
+}
+
+// Result summarizes one scenario. Latencies are in milliseconds.
+type Result struct {
+	Scenario    string  `json:"scenario"`
+	Concurrency int     `json:"concurrency"`
+	BodySize    int     `json:"body_size"`
+	Requests    int     `json:"requests"`
+	Errors      int     `json:"errors"`
+	Seconds     float64 `json:"seconds"`
+	RPS         float64 `json:"requests_per_second"`
+	BytesPerSec float64 `json:"bytes_per_second"`
+	P50         float64 `json:"p50_ms"`
+	P99         float64 `json:"p99_ms"`
+	Max         float64 `json:"max_ms"`
+}
+
+// After a failed request a worker pauses for retryBackoff, doubling up to
+// maxRetryBackoff while failures continue, so a dead target is not
+// hammered. maxFailures in a row end the scenario.
+const (
+	retryBackoff    = 10 * time.Millisecond
+	maxRetryBackoff = time.Second
+	maxFailures     = 10
+)
+
+// smallBody is what the echo service returns for a GET.
+var smallBody = bytes.Repeat([]byte("x"), 64)
+
+// Run executes the scenarios in order, calling report after each one, and
+// returns all results. Cancelling ctx, as Ctrl+C does, is a clean stop: Run
+// returns what was measured so far, including the scenario cut short, and
+// no error.
+func Run(ctx context.Context, cfg Config, report func(Result)) ([]Result, error) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	echoSrv := &http.Server{Handler: http.HandlerFunc(serveEcho)}
+	go echoSrv.Serve(echo)
+	defer echoSrv.Close()
+
+	publicAddr := cfg.PublicAddr
+	if publicAddr == "" {
+		srv, tunnelAddr, addr, err := startServer(cfg.Tunnel.StreamWindow)
+		if err != nil {
+			return nil, err
+		}
+		defer srv.Stop()
+		cfg.Tunnel.ServerAddr = tunnelAddr
+		publicAddr = addr
+	}
+
+	cfg.Tunnel.LocalAddr = echo.Addr().String()
+	c, err := client.New(cfg.Tunnel)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.Start(ctx); err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.Ready():
+	case <-c.Done():
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, nil
+	}
+
+	var results []Result
+	for _, sc := range cfg.Scenarios {
+		url, dial := c.TunnelURL, publicAddr
+		if sc.Direct {
+			url, dial = "http://"+echo.Addr().String(), echo.Addr().String()
+		}
+		res, err := runScenario(ctx, sc, url, dial, cfg.Duration)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Stopped before anything was measured.
+				return results, nil
+			}
+			return results, err
+		}
+		results = append(results, res)
+		if report != nil {
+			report(res)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results, nil
+}
+
+// startServer runs a server on loopback ports with no limits, using the
+// client's stream window for its side too.
+func startServer(window uint32) (*server.Server, string, string, error) {
+	tunnels, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", "", err
+	}
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tunnels.Close()
+		return nil, "", "", err
+	}
+	_, port, _ := net.SplitHostPort(public.Addr().String())
+	srv, err := server.New(server.Config{
+		Addr:       ":" + port,
+		TunnelAddr: tunnels.Addr().String(),
+		Domain:     "localhost",
+
+		StreamWindow: window,
+	})
+	if err != nil {
+		tunnels.Close()
+		public.Close()
+		return nil, "", "", err
+	}
+	go srv.Serve(tunnels, public)
+	return srv, tunnels.Addr().String(), public.Addr().String(), nil
+}
+
+func serveEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Write(smallBody)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, r.Body)
+}
+
+// runScenario sends requests to url from sc.Concurrency workers for d,
+// dialing dial for every connection so the tunnel host needs no DNS.
+func runScenario(ctx context.Context, sc Scenario, url, dial string, d time.Duration) (Result, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, dial)
+		},
+		MaxIdleConnsPerHost: sc.Concurrency,
+	}
+	defer transport.CloseIdleConnections()
+	hc := &http.Client{Transport: transport}
+
+	var body []byte
+	if sc.BodySize > 0 {
+		body = make([]byte, sc.BodySize)
+		rand.Read(body)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errs      atomic.Int64
+		moved     atomic.Int64
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for range sc.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			failures := 0
+			for ctx.Err() == nil {
+				t := time.Now()
+				n, err := send(ctx, hc, url, body)
+				if err != nil {
+					// Requests cut off by the end of the scenario, a
+					// worker giving up or Ctrl+C are not failures.
+					if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+						break
+					}
+					errs.Add(1)
+					if failures++; failures == maxFailures {
+						abort(fmt.Errorf("%s: %d requests in a row failed, the last with: %w", sc.Name, failures, err))
+						break
+					}
+					select {
+					case <-time.After(min(retryBackoff<<(failures-1), maxRetryBackoff)):
+					case <-ctx.Done():
+					}
+					continue
+				}
+				failures = 0
+				local = append(local, time.Since(t))
+				moved.Add(n)
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start).Seconds()
+	// A worker that gave up leaves its error as the cause.
+	if cause := context.Cause(ctx); cause != ctx.Err() {
+		return Result{}, cause
+	}
+
+	if len(latencies) == 0 {
+		return Result{}, fmt.Errorf("%s: no request succeeded (%d errors)", sc.Name, errs.Load())
+	}
+	slices.Sort(latencies)
+	return Result{
+		Scenario:    sc.Name,
+		Concurrency: sc.Concurrency,
+		BodySize:    sc.BodySize,
+		Requests:    len(latencies),
+		Errors:      int(errs.Load()),
+		Seconds:     elapsed,
+		RPS:         float64(len(latencies)) / elapsed,
+		BytesPerSec: float64(moved.Load()) / elapsed,
+		P50:         millis(percentile(latencies, 0.50)),
+		P99:         millis(percentile(latencies, 0.99)),
+		Max:         millis(latencies[len(latencies)-1]),
+	}, nil
+}
+
+// send makes one request and returns the bytes moved in both directions.
+func send(ctx context.Context, hc *http.Client, url string, body []byte) (int64, error) {
+	method, r := http.MethodGet, io.Reader(nil)
+	if body != nil {
+		method, r = http.MethodPost, bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url+"/echo", r)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	}
+	return int64(len(body)) + n, nil
+}
+
+// percentile returns the p-th latency of sorted, using the nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
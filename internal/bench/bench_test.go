@@ -0,0 +1,111 @@
+package bench_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport/internal/bench"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestRun(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	var reported []string
+	results, err := bench.Run(context.Background(), bench.Config{
+		Tunnel:     openporttest.ClientConfig{ServerAddr: srv.TunnelAddr},
+		PublicAddr: srv.PublicAddr,
+		Duration:   200 * time.Millisecond,
+		Scenarios: []bench.Scenario{
+			{Name: "direct", Concurrency: 2, Direct: true},
+			{Name: "small", Concurrency: 2},
+			{Name: "large", Concurrency: 2, BodySize: 64 << 10},
+		},
+	}, func(r bench.Result) { reported = append(reported, r.Scenario) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(reported, ",") != "direct,small,large" {
+		t.Fatalf("reported %v, want direct, small and large", reported)
+	}
+
+	// op bench --json prints the results as they are.
+	b, err := json.Marshal(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]any
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range decoded {
+		if r["requests"].(float64) == 0 || r["errors"].(float64) != 0 {
+			t.Errorf("%s: %v requests with %v errors, want some and none", r["scenario"], r["requests"], r["errors"])
+		}
+		for _, key := range []string{"requests_per_second", "bytes_per_second", "p50_ms", "p99_ms"} {
+			if v, _ := r[key].(float64); v <= 0 {
+				t.Errorf("%s: %s is %v", r["scenario"], key, r[key])
+			}
+		}
+	}
+	if got := decoded[2]["body_size"]; got != float64(64<<10) {
+		t.Errorf("large: body_size %v", got)
+	}
+}
+
+func TestRunGivesUp(t *testing.T) {
+	t.Parallel()
+	// Nothing listens on the public address, so every request fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	start := time.Now()
+	results, err := bench.Run(context.Background(), bench.Config{
+		Tunnel:     openporttest.ClientConfig{ServerAddr: srv.TunnelAddr},
+		PublicAddr: dead,
+		Duration:   time.Minute,
+		Scenarios:  []bench.Scenario{{Name: "small", Concurrency: 2}, {Name: "large", Concurrency: 2, BodySize: 1024}},
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "small: 10 requests in a row failed") {
+		t.Fatalf("got %v, want small to give up after 10 failures", err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("got results %+v after giving up", results)
+	}
+	// The backoff adds up to a few seconds, well short of the duration.
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	results, err := bench.Run(ctx, bench.Config{
+		Tunnel:     openporttest.ClientConfig{ServerAddr: srv.TunnelAddr},
+		PublicAddr: srv.PublicAddr,
+		Duration:   time.Minute,
+		Scenarios:  []bench.Scenario{{Name: "small", Concurrency: 4}, {Name: "large", Concurrency: 2, BodySize: 1024}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Ctrl+C returned %v, want a clean stop", err)
+	}
+	// The scenario cut short is kept; requests it abandoned are not errors.
+	if len(results) != 1 || results[0].Scenario != "small" || results[0].Requests == 0 || results[0].Errors != 0 {
+		t.Fatalf("got %+v, want small alone with requests and no errors", results)
+	}
+	if results[0].Seconds > 5 {
+		t.Fatalf("small ran %.1fs after being stopped at 0.3s", results[0].Seconds)
+	}
+}
@@ -2,29 +2,47 @@ package client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/yamux"
 	"github.com/nitintf/openport/internal/tunnel"
 )
 
 var (
-	ErrLocalNotReachable  = errors.New("local not reachable")
-	ErrServerUnreachable  = errors.New("server unreachable")
-	ErrSubdomainTaken     = errors.New("subdomain taken")
-	ErrConnectionLost     = errors.New("connection lost")
+	ErrLocalNotReachable = errors.New("local not reachable")
+	ErrServerUnreachable = errors.New("server unreachable")
+	ErrSubdomainTaken    = errors.New("subdomain taken")
+	ErrConnectionLost    = errors.New("connection lost")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrTooManyTunnels    = errors.New("too many tunnels")
+	ErrTunnelExpired     = errors.New("tunnel expired")
+	ErrDomainUnverified  = errors.New("domain unverified")
+	ErrDomainTaken       = errors.New("domain taken")
+	ErrUnsupported       = errors.New("unsupported")
+	ErrPortsExhausted    = errors.New("no free port")
+	ErrProxy             = errors.New("proxy failed")
+	ErrCertificate       = errors.New("certificate unavailable")
+
+	// ErrClosed is reported by Err once the client was closed on purpose.
+	ErrClosed = errors.New("client closed")
 )
 
 // ConnectError wraps an error with human-readable context.
 type ConnectError struct {
-	Kind    error
-	Addr    string
-	Detail  string
+	Kind   error
+	Addr   string
+	Detail string
 }
 
 func (e *ConnectError) Error() string {
@@ -37,24 +55,294 @@ func (e *ConnectError) Unwrap() error {
 
 // Config holds client configuration.
 type Config struct {
-	ServerAddr  string
-	LocalAddr   string
-	Subdomain   string
+	Type       string // tunnel.TypeHTTP (default), tunnel.TypeTLS or tunnel.TypeUDP
+	ServerAddr string // host:port of the server's tunnel listener
+	LocalAddr  string
+	Subdomain  string
+	Token      string  // auth token presented to the server
+	RateLimit  float64 // requested requests per second (0 = server default)
+	RateBurst  int
+	Bandwidth  int64 // requested bytes per second (0 = server default)
+
+	// ServerURL carries the tunnel over a WebSocket instead, for networks
+	// that only let HTTP(S) out, e.g.
+	// wss://tunnel.example.com/_openport/connect. With ServerAddr also set,
+	// it is the fallback when ServerAddr can't be reached.
+	ServerURL string
+
+	// Transport is how to reach ServerAddr: TransportTCP (the default)
+	// multiplexes requests over one TCP connection, and TransportQUIC gives
+	// each its own QUIC stream, so one stalled download does not hold up
+	// the rest, and follows this machine onto a new network when its
+	// address changes.
+	Transport string
+
+	// ServerInsecure skips verifying the server's certificate over QUIC and
+	// wss://, and ServerCA adds a PEM file of CAs trusted for it.
+	ServerInsecure bool
+	ServerCA       string
+
+	// Proxy is the URL of an egress proxy to reach the server through over
+	// TCP and WebSockets: http:// or https:// for HTTP CONNECT, or
+	// socks5://, with credentials as its user info. When empty, HTTPS_PROXY
+	// or else ALL_PROXY is used, unless NO_PROXY excludes the server.
+	Proxy string
+
+	// Pool shares the subdomain with other clients using the same Token.
+	// Balance and Sticky configure the pool when this client creates it.
+	Pool    bool
+	Balance string // "round-robin" (default) or "least-in-flight"
+	Sticky  bool
+
+	// Domains are custom hostnames to serve through the tunnel. Each needs
+	// a CNAME to the server and a TXT record from DomainRecord.
+	Domains []string
+
+	// LocalNetwork is "tcp" (the default) or "unix", in which case
+	// LocalAddr is a socket path.
+	LocalNetwork string
+
+	// LocalScheme is "http" (the default) or "https" for local services
+	// that only speak TLS.
+	LocalScheme string
+
+	// LocalHTTP2 talks cleartext HTTP/2 (h2c) to http:// local services,
+	// as gRPC servers expect. https services negotiate HTTP/2 on their own.
+	LocalHTTP2 bool
+
+	// Routes send matching path prefixes to other local services. Requests
+	// that match no route go to LocalAddr.
+	Routes []Route
+
+	// UpstreamInsecure skips certificate verification for an https local
+	// service, and UpstreamCA adds a PEM file of trusted CAs for it.
+	UpstreamInsecure bool
+	UpstreamCA       string
+
+	// HostHeader controls the Host header sent to the local service:
+	// HostPreserve (the default) keeps the public host, HostRewrite
+	// replaces it with LocalAddr, and any other value is sent as is.
+	HostHeader string
+
+	// ResponseTimeout bounds how long the local service may take to send
+	// response headers (0 = DefaultResponseTimeout).
+	ResponseTimeout time.Duration
+
+	// StreamWindow is how many bytes of a request each tunnel stream may
+	// have in flight toward this client (0 = yamux's 256 KiB minimum, at
+	// most 16 MiB). Larger windows speed up big uploads over slow links.
+	StreamWindow uint32
+
+	// E2E terminates visitors' TLS in the client, so the server relays
+	// ciphertext it cannot read, and forwards the decrypted requests to the
+	// local services. The server must offer TLS passthrough. The
+	// certificate comes from CertFile and KeyFile, or else from ACME for
+	// the tunnel's hosts, with the server passing on HTTP-01 challenges;
+	// CertDir caches it and ACMEEmail is given to the CA.
+	E2E       bool
+	CertFile  string
+	KeyFile   string
+	CertDir   string
+	ACMEEmail string
+
+	// Compress offers to gzip text-like bodies through the tunnel, for slow
+	// links. It takes effect when the server agrees, and only for requests
+	// forwarded to local services, not for a Handler or Listen.
+	Compress bool
+
+	// Handler, when set, answers requests in-process instead of forwarding
+	// them to LocalAddr.
+	Handler http.Handler
+
+	// Listen delivers each public connection through Listener instead, for
+	// callers that run their own server on it.
+	Listen bool
+
 	OnConnected func(tunnelURL string)
 	OnRequest   func(RequestLog)
 }
 
+// Values for Config.Transport.
+const (
+	TransportTCP  = "tcp"
+	TransportQUIC = "quic"
+)
+
 // Client connects to the openport server and forwards traffic to a local service.
 type Client struct {
-	cfg       Config
-	conn      net.Conn
-	session   *yamux.Session
+	cfg        Config
+	stats      tunnel.Stats
+	compressed tunnel.CompressionStats
+
+	// mu guards the connection state, which Close may read while the
+	// goroutine started by Start is still filling it in.
+	mu       sync.Mutex
+	conn     net.Conn
+	session  tunnel.Session
+	started  bool
+	closed   bool
+	draining bool // set by Shutdown; no more streams are taken on
+
+	ready  chan struct{}
+	done   chan struct{}
+	err    error          // set before done is closed
+	active sync.WaitGroup // streams being handled
+
+	handlerSrv *http.Server
+	serverTLS  *tls.Config // for QUIC and wss://
+	proxy      *url.URL    // parsed Config.Proxy
+	e2e        *e2eServer  // set with Config.E2E
+	failure    error       // why the client ended the session itself, guarded by mu
+	records    bool        // set by DomainRecord: ask for TXT values, open no tunnel
+
+	notice    atomic.Pointer[tunnel.Notice]
+	upstreams []upstream
+	streams   *streamListener
 	TunnelURL string
+
+	// compression is the payload compression agreed with the server.
+	compression string
+
+	// DomainURLs are the public URLs of the bound custom domains.
+	DomainURLs []string
 }
 
+// Values for Config.HostHeader.
+const (
+	HostPreserve = "preserve"
+	HostRewrite  = "rewrite"
+)
+
+// DefaultResponseTimeout is used when Config.ResponseTimeout is unset.
+const DefaultResponseTimeout = 60 * time.Second
+
+// handshakeTimeout bounds the exchange of handshake messages with the server.
+const handshakeTimeout = 10 * time.Second
+
 // New creates a new Client.
 func New(cfg Config) (*Client, error) {
-	return &Client{cfg: cfg}, nil
+	if cfg.ResponseTimeout <= 0 {
+		cfg.ResponseTimeout = DefaultResponseTimeout
+	}
+	if cfg.Pool && cfg.Token == "" {
+		return nil, errors.New("shared pools require an auth token")
+	}
+	switch cfg.Balance {
+	case "", tunnel.BalanceRoundRobin, tunnel.BalanceLeastInFlight:
+	default:
+		return nil, fmt.Errorf("unknown balance strategy %q (want %s or %s)", cfg.Balance, tunnel.BalanceRoundRobin, tunnel.BalanceLeastInFlight)
+	}
+	if cfg.HostHeader == "" {
+		cfg.HostHeader = HostPreserve
+	}
+	switch cfg.LocalNetwork {
+	case "":
+		cfg.LocalNetwork = "tcp"
+	case "tcp", "unix":
+	default:
+		return nil, fmt.Errorf("unsupported local network %q", cfg.LocalNetwork)
+	}
+	switch cfg.LocalScheme {
+	case "":
+		cfg.LocalScheme = "http"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported local scheme %q", cfg.LocalScheme)
+	}
+	if cfg.ServerURL != "" {
+		if u, err := url.Parse(cfg.ServerURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			return nil, fmt.Errorf("server URL %q is not a ws:// or wss:// URL", cfg.ServerURL)
+		}
+	}
+	switch cfg.Transport {
+	case "":
+		cfg.Transport = TransportTCP
+	case TransportTCP, TransportQUIC:
+	default:
+		return nil, fmt.Errorf("unsupported transport %q (want %s or %s)", cfg.Transport, TransportTCP, TransportQUIC)
+	}
+	serverTLS, err := newServerTLS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var proxyURL *url.URL
+	if cfg.Proxy != "" {
+		if cfg.Transport == TransportQUIC && cfg.ServerURL == "" {
+			return nil, errors.New("QUIC runs over UDP and cannot go through a proxy")
+		}
+		if proxyURL, err = parseProxy(cfg.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Handler != nil && cfg.Listen {
+		return nil, errors.New("use either a handler or a listener, not both")
+	}
+	switch cfg.Type {
+	case "":
+		cfg.Type = tunnel.TypeHTTP
+	case tunnel.TypeHTTP:
+	case tunnel.TypeTLS:
+		if cfg.Handler != nil || cfg.Listen || len(cfg.Routes) > 0 {
+			return nil, errors.New("tls tunnels relay raw connections and cannot use a handler or routes")
+		}
+	case tunnel.TypeUDP:
+		if cfg.Handler != nil || cfg.Listen || len(cfg.Routes) > 0 || cfg.Pool {
+			return nil, errors.New("udp tunnels cannot use a handler, routes or pools")
+		}
+		if cfg.LocalNetwork != "tcp" {
+			return nil, errors.New("udp tunnels need a host:port local address")
+		}
+		cfg.LocalNetwork = "udp"
+	default:
+		return nil, fmt.Errorf("unsupported tunnel type %q", cfg.Type)
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("a certificate needs both a cert and a key file")
+	}
+	var e2e *e2eServer
+	if cfg.E2E {
+		if cfg.Type != tunnel.TypeHTTP || cfg.Handler != nil || cfg.Listen {
+			return nil, errors.New("end-to-end encryption forwards HTTP to local services and cannot use a handler or other tunnel types")
+		}
+		if e2e, err = newE2E(cfg); err != nil {
+			return nil, err
+		}
+	} else if cfg.CertFile != "" {
+		return nil, errors.New("a certificate is only used with end-to-end encryption")
+	}
+
+	upstreams, err := buildUpstreams(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cfg:       cfg,
+		upstreams: upstreams,
+		serverTLS: serverTLS,
+		proxy:     proxyURL,
+		e2e:       e2e,
+		ready:     make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if cfg.Handler != nil || cfg.Listen {
+		c.streams = newStreamListener()
+	}
+	if cfg.Handler != nil {
+		c.handlerSrv = &http.Server{Handler: c.logRequests(cfg.Handler)}
+	}
+	return c, nil
+}
+
+// Listener returns the listener that yields public connections when
+// Config.Listen is set, or nil otherwise. Each connection carries HTTP/1.1
+// requests, so an http.Server can Serve on it directly.
+func (c *Client) Listener() net.Listener {
+	if !c.cfg.Listen {
+		return nil
+	}
+	return c.streams
 }
 
 // Port extracts the port number from the local address.
@@ -63,149 +351,562 @@ func (c *Client) Port() string {
 	return port
 }
 
-// Connect establishes a tunnel with the server and begins forwarding traffic.
+// Connect establishes a tunnel with the server and forwards traffic until
+// the tunnel ends. It is Start followed by waiting on Done.
 func (c *Client) Connect() error {
-	localConn, err := net.DialTimeout("tcp", c.cfg.LocalAddr, 2*time.Second)
-	if err != nil {
-		return &ConnectError{
-			Kind: ErrLocalNotReachable,
-			Addr: c.cfg.LocalAddr,
-			Detail: fmt.Sprintf("port %s", c.Port()),
-		}
+	if err := c.Start(context.Background()); err != nil {
+		return err
 	}
-	localConn.Close()
+	<-c.Done()
+	return c.Err()
+}
 
-	c.conn, err = net.Dial("tcp", c.cfg.ServerAddr)
-	if err != nil {
-		return &ConnectError{
-			Kind:   ErrServerUnreachable,
-			Addr:   c.cfg.ServerAddr,
-			Detail: c.cfg.ServerAddr,
-		}
+// Start connects to the server in the background and returns at once. Ready
+// is closed when the tunnel is up; Done and Err report when and why it
+// ended. Cancelling ctx closes the tunnel.
+func (c *Client) Start(ctx context.Context) error {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return errors.New("client already started")
 	}
+	c.started = true
+	c.mu.Unlock()
 
-	err = tunnel.SendHandshake(c.conn, tunnel.Handshake{
-		Subdomain: c.cfg.Subdomain,
-	})
-	if err != nil {
-		return &ConnectError{
-			Kind:   ErrServerUnreachable,
-			Addr:   c.cfg.ServerAddr,
-			Detail: "handshake failed",
+	stop := context.AfterFunc(ctx, c.Close)
+	go func() {
+		err := c.run(ctx)
+		stop()
+
+		c.mu.Lock()
+		switch {
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		case c.closed:
+			err = ErrClosed
 		}
+		c.mu.Unlock()
+		c.Close()
+
+		c.err = err
+		close(c.done)
+	}()
+	return nil
+}
+
+// Ready is closed once the server has accepted the tunnel and TunnelURL is
+// set. It stays open if connecting fails; watch Done as well.
+func (c *Client) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Done is closed when the tunnel has ended, after which Err says why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the tunnel ended: ErrClosed after Close or Shutdown, the
+// context's error if it was cancelled, or a *ConnectError. It is nil while
+// the tunnel is running.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
 	}
+}
 
-	resp, err := tunnel.ReadHandshakeResp(c.conn)
-	if err != nil {
-		return &ConnectError{
-			Kind:   ErrServerUnreachable,
-			Addr:   c.cfg.ServerAddr,
-			Detail: "no response from server",
-		}
+// Shutdown stops the server from sending new requests, waits for those in
+// flight to finish or for ctx to expire, then closes the tunnel. Connections
+// handed out by Listener belong to the caller and are not waited for.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	session := c.session
+	c.draining = true
+	c.mu.Unlock()
+	if session != nil {
+		session.GoAway()
 	}
-	if resp.Error != "" {
-		if strings.Contains(resp.Error, "already in use") {
-			return &ConnectError{
-				Kind:   ErrSubdomainTaken,
-				Addr:   c.cfg.Subdomain,
-				Detail: c.cfg.Subdomain,
-			}
+
+	drained := make(chan struct{})
+	go func() {
+		c.active.Wait()
+		if c.handlerSrv != nil {
+			c.handlerSrv.Shutdown(ctx)
 		}
-		return &ConnectError{
-			Kind:   ErrServerUnreachable,
-			Addr:   c.cfg.ServerAddr,
-			Detail: resp.Error,
+		if c.e2e != nil {
+			c.e2e.shutdown(ctx)
 		}
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
 	}
+	c.Close()
+	<-c.done
+	return err
+}
 
-	c.TunnelURL = resp.URL
+// run connects, registers the tunnel and serves streams until the session
+// ends.
+func (c *Client) run(ctx context.Context) error {
+	var dialer net.Dialer
+	if c.streams == nil {
+		for _, up := range c.upstreams {
+			dctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			localConn, err := dialer.DialContext(dctx, up.Target.Network, up.Target.Addr)
+			cancel()
+			if err != nil {
+				return &ConnectError{
+					Kind:   ErrLocalNotReachable,
+					Addr:   up.Target.Addr,
+					Detail: up.Target.describe(),
+				}
+			}
+			localConn.Close()
+		}
+	}
 
-	if c.cfg.OnConnected != nil {
-		c.cfg.OnConnected(resp.URL)
+	conn, resp, err := c.connect(ctx)
+	if err != nil {
+		return err
 	}
 
-	c.session, err = yamux.Server(c.conn, nil)
+	session, err := tunnel.ClientSession(conn, c.cfg.StreamWindow)
 	if err != nil {
 		return &ConnectError{
 			Kind:   ErrConnectionLost,
-			Addr:   c.cfg.ServerAddr,
+			Addr:   c.server(),
 			Detail: "failed to establish multiplexed session",
 		}
 	}
+	c.mu.Lock()
+	c.session = session
+	c.mu.Unlock()
+
+	c.TunnelURL = resp.URL
+	c.DomainURLs = resp.Domains
+	c.compression = resp.Compression
+
+	connected := func() {
+		close(c.ready)
+		if c.cfg.OnConnected != nil {
+			c.cfg.OnConnected(resp.URL)
+		}
+	}
+	if c.e2e != nil {
+		// Visitors can't connect until there is a certificate, which
+		// ACME may take a while to issue over the tunnel.
+		hosts := c.tunnelHosts()
+		c.e2e.start(c, hosts, resp.ACMEDirectory)
+		go func() {
+			if err := c.e2e.certify(hosts); err != nil {
+				c.fail(certificateError(err))
+				return
+			}
+			connected()
+		}()
+	} else {
+		connected()
+	}
+
+	if c.cfg.Handler != nil {
+		go c.handlerSrv.Serve(c.streams)
+	}
 
 	for {
-		stream, err := c.session.Accept()
+		stream, err := session.Accept()
 		if err != nil {
+			c.mu.Lock()
+			failure := c.failure
+			c.mu.Unlock()
+			if failure != nil {
+				return failure
+			}
+			if n := c.notice.Load(); n != nil {
+				return c.noticeError(*n)
+			}
 			return &ConnectError{
 				Kind:   ErrConnectionLost,
-				Addr:   c.cfg.ServerAddr,
+				Addr:   c.server(),
 				Detail: "tunnel disconnected",
 			}
 		}
-		go c.handleStream(stream)
+		// Streams the server opened before it saw GoAway are refused, as
+		// Shutdown may already be waiting for the others.
+		c.mu.Lock()
+		if c.draining {
+			c.mu.Unlock()
+			stream.Close()
+			continue
+		}
+		c.active.Add(1)
+		c.mu.Unlock()
+		go func() {
+			defer c.active.Done()
+			c.handleStream(tunnel.Meter(stream, &c.stats.BytesIn, &c.stats.BytesOut, nil))
+		}()
+	}
+}
+
+// offerCompression lists the compressions to offer the server, if any.
+func (c *Client) offerCompression() []string {
+	if !c.cfg.Compress || c.cfg.Type != tunnel.TypeHTTP || c.streams != nil || c.e2e != nil {
+		return nil
+	}
+	return []string{tunnel.CompressionGzip}
+}
+
+// server names the server in errors.
+func (c *Client) server() string {
+	if c.cfg.ServerAddr == "" {
+		return c.cfg.ServerURL
+	}
+	return c.cfg.ServerAddr
+}
+
+func (c *Client) handshakeError(resp tunnel.HandshakeResp) error {
+	switch resp.Code {
+	case tunnel.CodeSubdomainTaken:
+		return &ConnectError{
+			Kind:   ErrSubdomainTaken,
+			Addr:   c.cfg.Subdomain,
+			Detail: c.cfg.Subdomain,
+		}
+	case tunnel.CodeUnauthorized:
+		return &ConnectError{
+			Kind:   ErrUnauthorized,
+			Addr:   c.server(),
+			Detail: resp.Error,
+		}
+	case tunnel.CodeTooManyTunnels:
+		return &ConnectError{
+			Kind:   ErrTooManyTunnels,
+			Addr:   c.server(),
+			Detail: resp.Error,
+		}
+	case tunnel.CodeDomainUnverified:
+		return &ConnectError{
+			Kind:   ErrDomainUnverified,
+			Addr:   c.server(),
+			Detail: resp.Error,
+		}
+	case tunnel.CodeDomainTaken:
+		return &ConnectError{
+			Kind:   ErrDomainTaken,
+			Addr:   c.server(),
+			Detail: resp.Error,
+		}
+	case tunnel.CodeUnsupported:
+		return &ConnectError{
+			Kind:   ErrUnsupported,
+			Addr:   c.server(),
+			Detail: resp.Error,
+		}
+	case tunnel.CodePortsExhausted:
+		return &ConnectError{
+			Kind:   ErrPortsExhausted,
+			Addr:   c.server(),
+			Detail: resp.Error,
+		}
+	}
+	return &ConnectError{
+		Kind:   ErrServerUnreachable,
+		Addr:   c.server(),
+		Detail: resp.Error,
+	}
+}
+
+// fail ends the session, with err as the reason the tunnel ended.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	c.failure = err
+	session := c.session
+	c.mu.Unlock()
+	session.Close()
+}
+
+func (c *Client) noticeError(n tunnel.Notice) error {
+	switch n.Code {
+	case tunnel.CodeIdleTimeout, tunnel.CodeLifetimeExceeded:
+		return &ConnectError{
+			Kind:   ErrTunnelExpired,
+			Addr:   c.server(),
+			Detail: n.Message,
+		}
+	}
+	return &ConnectError{
+		Kind:   ErrConnectionLost,
+		Addr:   c.server(),
+		Detail: n.Message,
 	}
 }
 
+// Traffic reports the total bytes received from and sent to the server.
+func (c *Client) Traffic() (in, out uint64) {
+	return c.stats.BytesIn.Load(), c.stats.BytesOut.Load()
+}
+
+// CompressionRatio reports how many times smaller compressed response bodies
+// were on the wire, or 0 while nothing has been compressed.
+func (c *Client) CompressionRatio() float64 {
+	return c.compressed.Ratio()
+}
+
 func (c *Client) handleStream(stream net.Conn) {
-	defer stream.Close()
+	kind, err := tunnel.ReadStreamKind(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	switch kind {
+	case tunnel.StreamHTTP:
+		switch {
+		case c.e2e != nil:
+			// Only ACME challenges come in plain HTTP.
+			c.e2e.challenges.deliver(stream)
+			return
+		case c.streams != nil:
+			// The in-process HTTP server owns the stream from here.
+			c.streams.deliver(stream)
+			return
+		}
+		c.serveHTTP(stream)
+	case tunnel.StreamTLS:
+		if c.e2e != nil {
+			c.e2e.conns.deliver(stream)
+			return
+		}
+		c.relayLocal(stream)
+	case tunnel.StreamUDP:
+		c.relayUDP(stream)
+	case tunnel.StreamNotice:
+		var n tunnel.Notice
+		if err := json.NewDecoder(stream).Decode(&n); err == nil {
+			c.notice.Store(&n)
+		}
+	}
+	stream.Close()
+}
 
-	req, err := http.ReadRequest(bufio.NewReader(stream))
+// relayLocal pipes a raw connection from the server to the local service.
+func (c *Client) relayLocal(stream net.Conn) {
+	local, err := net.DialTimeout(c.cfg.LocalNetwork, c.cfg.LocalAddr, 5*time.Second)
 	if err != nil {
 		return
 	}
+	defer local.Close()
+	tunnel.Relay(stream, local)
+}
+
+func (c *Client) serveHTTP(stream net.Conn) {
+	br := bufio.NewReader(stream)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+
+	// The server closes the stream when the visitor goes away. Once the
+	// request has been read, watch for that and stop the local service as
+	// http.Server would, instead of streaming into a stream nobody reads.
+	// Upgraded connections go on reading br themselves.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+	if req.Header.Get("Upgrade") == "" {
+		watch := func() {
+			go func() {
+				br.Peek(1)
+				cancel()
+				stream.Close()
+			}()
+		}
+		if req.Body == http.NoBody {
+			watch()
+		} else {
+			req.Body = &eofBody{ReadCloser: req.Body, onEOF: sync.OnceFunc(watch)}
+		}
+	}
+
+	if c.compression != "" {
+		if body, length, ok := tunnel.DecompressBody(req.Header, req.Body); ok {
+			req.Body, req.ContentLength = body, length
+			if length >= 0 {
+				// It came chunked, but the local service gets the
+				// original framing.
+				req.TransferEncoding = nil
+			}
+		}
+	}
 
 	method := req.Method
 	path := req.URL.Path
 
-	req.URL.Scheme = "http"
-	req.URL.Host = c.cfg.LocalAddr
 	req.RequestURI = ""
+	up := c.route(req)
 
 	start := time.Now()
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := up.transport.RoundTrip(req)
 	duration := time.Since(start)
 
 	if err != nil {
-		errResp := &http.Response{
-			StatusCode: http.StatusBadGateway,
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header:     make(http.Header),
-		}
-		errResp.Write(stream)
-
-		if c.cfg.OnRequest != nil {
-			c.cfg.OnRequest(RequestLog{
-				Method:     method,
-				Path:       path,
-				StatusCode: http.StatusBadGateway,
-				Duration:   duration,
-				Timestamp:  start,
-			})
+		status, msg := http.StatusBadGateway, "openport: local service unavailable"
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			status, msg = http.StatusGatewayTimeout, "openport: local service timed out"
 		}
+		errorResponse(status, msg).Write(stream)
+		c.logRequest(method, path, status, duration, start)
 		return
 	}
 	defer resp.Body.Close()
 
-	resp.Write(stream)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The transport hands back the upgraded connection, e.g. a
+		// WebSocket, as the body.
+		if local, ok := resp.Body.(io.ReadWriteCloser); ok {
+			resp.Body = nil
+			if resp.Write(stream) == nil {
+				c.logRequest(method, path, resp.StatusCode, duration, start)
+				tunnel.Relay(struct {
+					io.Reader
+					io.WriteCloser
+				}{br, stream}, local)
+			}
+			return
+		}
+	}
+
+	if c.compression != "" && method != http.MethodHead && bodyAllowed(resp.StatusCode) &&
+		tunnel.Compressible(resp.Header, resp.ContentLength) {
+		resp.Body, resp.ContentLength = tunnel.CompressBody(resp.Header, resp.Body, resp.ContentLength, &c.compressed)
+	}
+
+	// Coalesce the status line, headers and small bodies into one frame.
+	mw := tunnel.NewMessageWriter(stream)
+	defer mw.Release()
+	resp.Body = mw.Body(resp.Body)
+	if writeResponse(mw, resp) == nil {
+		mw.Flush()
+	}
+	c.logRequest(method, path, resp.StatusCode, duration, start)
+}
+
+// eofBody calls onEOF once the body has been read to the end.
+type eofBody struct {
+	io.ReadCloser
+	onEOF func()
+}
 
+func (b *eofBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.onEOF()
+	}
+	return n, err
+}
+
+// logRequest reports a request to OnRequest, if set.
+func (c *Client) logRequest(method, path string, status int, duration time.Duration, start time.Time) {
 	if c.cfg.OnRequest != nil {
 		c.cfg.OnRequest(RequestLog{
 			Method:     method,
 			Path:       path,
-			StatusCode: resp.StatusCode,
+			StatusCode: status,
 			Duration:   duration,
 			Timestamp:  start,
 		})
 	}
 }
 
-// Close tears down the tunnel connection.
+// writeResponse serializes resp onto the stream as HTTP/1.1, whatever
+// protocol the local service spoke. Bodies of unknown length are chunked so
+// trailers, which HTTP/2 services such as gRPC send after the body, survive
+// the trip.
+func writeResponse(w io.Writer, resp *http.Response) error {
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 {
+		resp.TransferEncoding = []string{"chunked"}
+		if resp.Trailer == nil {
+			// The transport fills this in once the body is read.
+			resp.Trailer = make(http.Header)
+		}
+	}
+	return resp.Write(w)
+}
+
+// bodyAllowed reports whether a response with status may carry a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func errorResponse(status int, msg string) *http.Response {
+	body := msg + "\n"
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return resp
+}
+
+// Close tears down the tunnel at once, dropping requests in flight. It is
+// safe to call at any time, including while Start is still connecting.
 func (c *Client) Close() {
-	if c.session != nil {
-		c.session.Close()
+	c.mu.Lock()
+	c.closed = true
+	conn, session := c.conn, c.session
+	if !c.started {
+		c.started = true
+		c.err = ErrClosed
+		close(c.done)
+	}
+	c.mu.Unlock()
+
+	if c.streams != nil {
+		c.streams.Close()
+	}
+	if c.e2e != nil {
+		c.e2e.close()
 	}
-	if c.conn != nil {
-		c.conn.Close()
+	if session != nil {
+		session.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// DomainRecord asks the server for the TXT record that proves ownership of
+// domain for a client presenting cfg.Token, and returns its name and value.
+// The server is reached as a tunnel would reach it with cfg.
+func DomainRecord(ctx context.Context, cfg Config, domain string) (name, value string, err error) {
+	cfg.Domains = []string{domain}
+	c, err := New(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	c.records = true
+	conn, resp, err := c.connect(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	conn.Close()
+	if len(resp.DomainRecords) != 1 {
+		return "", "", &ConnectError{
+			Kind:   ErrUnsupported,
+			Addr:   c.server(),
+			Detail: "the server sent no TXT record",
+		}
 	}
+	return tunnel.DomainRecordPrefix + domain, resp.DomainRecords[0], nil
 }
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// FuzzWriteResponse checks that what serveHTTP puts on a stream is read back
+// by the server as the same response.
+func FuzzWriteResponse(f *testing.F) {
+	f.Add(200, "hello", true, "Grpc-Status", "0")
+	f.Add(204, "", false, "", "")
+	f.Add(404, "not found\n", false, "X", "y")
+	f.Add(500, "\r\n0\r\n\r\n", true, "Content-Length", "5")
+
+	f.Fuzz(func(t *testing.T, status int, body string, unknownLength bool, trailerKey, trailerValue string) {
+		if status < 200 || status > 999 {
+			return
+		}
+		resp := &http.Response{
+			StatusCode:    status,
+			ProtoMajor:    2,
+			Header:        make(http.Header),
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}
+		if unknownLength {
+			resp.ContentLength = -1
+			if trailerKey != "" {
+				resp.Trailer = http.Header{trailerKey: {trailerValue}}
+			}
+		}
+
+		// Write it the way serveHTTP does.
+		var stream bytes.Buffer
+		mw := tunnel.NewMessageWriter(&stream)
+		defer mw.Release()
+		resp.Body = mw.Body(resp.Body)
+		if err := writeResponse(mw, resp); err != nil {
+			return
+		}
+		mw.Flush()
+		stream.WriteString("next")
+
+		br := bufio.NewReader(&stream)
+		got, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		gotBody, err := io.ReadAll(got.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+		if got.StatusCode != status {
+			t.Fatalf("got status %d, want %d", got.StatusCode, status)
+		}
+		if bodyAllowed(status) && string(gotBody) != body {
+			t.Fatalf("got body %q, want %q", gotBody, body)
+		}
+		if rest, _ := io.ReadAll(br); bodyAllowed(status) && string(rest) != "next" {
+			t.Fatalf("response overran its framing, left %q", rest)
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// e2eServer terminates TLS for an end-to-end encrypted tunnel, so the server
+// only relays ciphertext, and forwards the decrypted requests to the local
+// services.
+type e2eServer struct {
+	cert *tls.Certificate  // from CertFile, or nil to use ACME
+	acme *autocert.Manager // set by start when cert is nil
+
+	// conns carries visitors' TLS connections, and challenges the ACME
+	// HTTP-01 requests that the server passes on in plain HTTP.
+	conns      *streamListener
+	challenges *streamListener
+
+	mu           sync.Mutex // guards the servers, set by start
+	srv          *http.Server
+	challengeSrv *http.Server
+}
+
+// newE2E loads the certificate named in cfg, if any.
+func newE2E(cfg Config) (*e2eServer, error) {
+	e := &e2eServer{
+		conns:      newStreamListener(),
+		challenges: newStreamListener(),
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate: %w", err)
+		}
+		e.cert = &cert
+	}
+	return e, nil
+}
+
+// start serves the tunnel's TLS connections and challenges. Without a
+// certificate of the user's, one is obtained by ACME for hosts from the
+// directory the server offered.
+func (e *e2eServer) start(c *Client, hosts []string, directory string) {
+	tlsCfg := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	challenge := http.NotFoundHandler()
+	if e.cert != nil {
+		tlsCfg.Certificates = []tls.Certificate{*e.cert}
+	} else {
+		e.acme = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Email:      c.cfg.ACMEEmail,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+		}
+		if c.cfg.CertDir != "" {
+			e.acme.Cache = autocert.DirCache(c.cfg.CertDir)
+		}
+		if directory != "" {
+			e.acme.Client = &acme.Client{DirectoryURL: directory}
+		}
+		// Answers tls-alpn-01 challenges too, when visitors reach the
+		// passthrough listener on port 443.
+		tlsCfg = e.acme.TLSConfig()
+		challenge = e.acme.HTTPHandler(challenge)
+	}
+
+	srv := &http.Server{
+		Handler:   c.logRequests(c.e2eHandler()),
+		TLSConfig: tlsCfg,
+	}
+	challengeSrv := &http.Server{Handler: challenge}
+	e.mu.Lock()
+	e.srv, e.challengeSrv = srv, challengeSrv
+	e.mu.Unlock()
+	go srv.ServeTLS(e.conns, "", "")
+	go challengeSrv.Serve(e.challenges)
+}
+
+// certify makes sure there is a certificate valid for every host, obtaining
+// it first when ACME is used.
+func (e *e2eServer) certify(hosts []string) error {
+	for _, host := range hosts {
+		if e.acme != nil {
+			// Ask as a modern browser would, so the ECDSA certificate
+			// visitors get is the one issued up front.
+			_, err := e.acme.GetCertificate(&tls.ClientHelloInfo{
+				ServerName:   host,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", host, err)
+			}
+			continue
+		}
+		leaf, err := x509.ParseCertificate(e.cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		if err := leaf.VerifyHostname(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shutdown stops serving once the connections in flight are done.
+func (e *e2eServer) shutdown(ctx context.Context) {
+	e.mu.Lock()
+	srv, challengeSrv := e.srv, e.challengeSrv
+	e.mu.Unlock()
+	if srv != nil {
+		srv.Shutdown(ctx)
+		challengeSrv.Shutdown(ctx)
+	}
+}
+
+func (e *e2eServer) close() {
+	e.conns.Close()
+	e.challenges.Close()
+	e.mu.Lock()
+	srv, challengeSrv := e.srv, e.challengeSrv
+	e.mu.Unlock()
+	if srv != nil {
+		srv.Close()
+		challengeSrv.Close()
+	}
+}
+
+// e2eHandler forwards decrypted requests to the local services as serveHTTP
+// does for requests the server decrypted.
+func (c *Client) e2eHandler() http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The visitor's address stays with the server, so only the
+			// host and scheme are passed on.
+			pr.Out.Header.Set("X-Forwarded-Host", pr.In.Host)
+			pr.Out.Header.Set("X-Forwarded-Proto", "https")
+			up := c.route(pr.Out)
+			pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), upstreamKey{}, up))
+		},
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return req.Context().Value(upstreamKey{}).(upstream).transport.RoundTrip(req)
+		}),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status, msg := http.StatusBadGateway, "openport: local service unavailable"
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				status, msg = http.StatusGatewayTimeout, "openport: local service timed out"
+			}
+			http.Error(w, msg, status)
+		},
+	}
+}
+
+type upstreamKey struct{}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// tunnelHosts returns the public hosts of the tunnel, which its certificate
+// must cover.
+func (c *Client) tunnelHosts() []string {
+	var hosts []string
+	for _, raw := range append([]string{c.TunnelURL}, c.DomainURLs...) {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts
+}
+
+// E2E reports whether the server cannot read the tunnel's traffic, as TLS is
+// terminated by the client.
+func (c *Client) E2E() bool {
+	return c.e2e != nil
+}
+
+// certificateError reports a certificate that cannot serve the tunnel.
+func certificateError(err error) error {
+	return &ConnectError{
+		Kind:   ErrCertificate,
+		Detail: err.Error(),
+	}
+}
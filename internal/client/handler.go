@@ -0,0 +1,99 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamListener hands tunnel streams to an in-process http.Server, so a
+// Handler can answer requests without a separate local server.
+type streamListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newStreamListener() *streamListener {
+	return &streamListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver passes a stream to the server, or closes it if the listener has
+// been shut down.
+func (l *streamListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "openport" }
+func (tunnelAddr) String() string  { return "openport" }
+
+// logRequests reports every request served by h through OnRequest, so the
+// log looks the same as when proxying to a local service.
+func (c *Client) logRequests(h http.Handler) http.Handler {
+	if c.cfg.OnRequest == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		c.cfg.OnRequest(RequestLog{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			StatusCode: rec.status,
+			Duration:   time.Since(start),
+			Timestamp:  start,
+		})
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// parseProxy checks a Config.Proxy URL.
+func parseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("proxy %q is not a URL", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	return u, nil
+}
+
+// proxyFromEnvironment returns the proxy for reaching addr named by
+// HTTPS_PROXY, or else ALL_PROXY, or nil when there is none or NO_PROXY
+// excludes addr. Loopback addresses are never proxied.
+func proxyFromEnvironment(addr string) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if cfg.HTTPSProxy == "" {
+		cfg.HTTPSProxy = os.Getenv("ALL_PROXY")
+		if cfg.HTTPSProxy == "" {
+			cfg.HTTPSProxy = os.Getenv("all_proxy")
+		}
+	}
+	u, err := cfg.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || u == nil {
+		return nil, err
+	}
+	return parseProxy(u.String())
+}
+
+// dialServer opens a TCP connection to addr, through Config.Proxy or the
+// proxy from the environment if there is one. Failures at the proxy are
+// reported as a *ConnectError with ErrProxy.
+func (c *Client) dialServer(ctx context.Context, addr string) (net.Conn, error) {
+	proxyURL := c.proxy
+	if proxyURL == nil {
+		var err error
+		proxyURL, err = proxyFromEnvironment(addr)
+		if err != nil {
+			return nil, &ConnectError{Kind: ErrProxy, Detail: err.Error()}
+		}
+	}
+	if proxyURL == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := dialProxy(ctx, proxyURL, addr)
+	if err != nil {
+		return nil, &ConnectError{
+			Kind:   ErrProxy,
+			Addr:   proxyURL.Redacted(),
+			Detail: err.Error(),
+		}
+	}
+	return conn, nil
+}
+
+// dialProxy asks the proxy at proxyURL for a connection to addr, with the
+// credentials in its user info if any.
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	host := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}[proxyURL.Scheme]
+		host = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	var user, password string
+	if proxyURL.User != nil {
+		user = proxyURL.User.Username()
+		password, _ = proxyURL.User.Password()
+	}
+
+	if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			auth = &proxy.Auth{User: user, Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", host, auth, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	// Bound the exchange with the proxy by ctx.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what the proxy sent after its response before the
+// rest of the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
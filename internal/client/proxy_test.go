@@ -0,0 +1,183 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestDialProxy dials an echo server through stand-in HTTP CONNECT and
+// SOCKS5 proxies that require the credentials "user:secret".
+func TestDialProxy(t *testing.T) {
+	echo := listen(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	httpProxy := listen(t, serveConnect)
+	socksProxy := listen(t, serveSOCKS5)
+
+	for name, tc := range map[string]struct {
+		proxy   string
+		wantErr bool
+	}{
+		"http":            {proxy: "http://user:secret@" + httpProxy},
+		"http bad auth":   {proxy: "http://user:wrong@" + httpProxy, wantErr: true},
+		"http no auth":    {proxy: "http://" + httpProxy, wantErr: true},
+		"socks5":          {proxy: "socks5://user:secret@" + socksProxy},
+		"socks5 bad auth": {proxy: "socks5://user:wrong@" + socksProxy, wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := New(Config{ServerAddr: echo, LocalAddr: "127.0.0.1:1", Proxy: tc.proxy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := c.dialTCP(ctx)
+			if tc.wantErr {
+				if !errors.Is(err, ErrProxy) {
+					t.Fatalf("got %v, want ErrProxy", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, "ping")
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("echo through proxy: got %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("https_proxy", "")
+	t.Setenv("ALL_PROXY", "socks5://proxy.internal:1080")
+	t.Setenv("NO_PROXY", "direct.example.com")
+
+	for addr, want := range map[string]string{
+		"tunnel.example.com:9090": "socks5://proxy.internal:1080",
+		"direct.example.com:9090": "",
+		"127.0.0.1:9090":          "",
+	} {
+		u, err := proxyFromEnvironment(addr)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("%s: got proxy %q, want %q", addr, got, want)
+		}
+	}
+
+	t.Setenv("HTTPS_PROXY", "http://proxy.internal:3128")
+	if u, _ := proxyFromEnvironment("tunnel.example.com:9090"); u == nil || u.String() != "http://proxy.internal:3128" {
+		t.Errorf("HTTPS_PROXY: got proxy %v, want it over ALL_PROXY", u)
+	}
+}
+
+// listen serves each connection to a loopback listener with handle until the
+// test ends, and returns its address.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// relay copies between a client and the target it asked for.
+func relay(client io.ReadWriter, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, client)
+	io.Copy(client, target)
+}
+
+func serveConnect(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	relay(struct {
+		io.Reader
+		io.Writer
+	}{br, conn}, req.Host)
+}
+
+func serveSOCKS5(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	next := func(n int) []byte {
+		b := make([]byte, n)
+		io.ReadFull(br, b)
+		return b
+	}
+
+	// Greeting: insist on username/password authentication.
+	hello := next(2)
+	next(int(hello[1]))
+	conn.Write([]byte{5, 2})
+	ver := next(2)
+	user := string(next(int(ver[1])))
+	pass := string(next(int(next(1)[0])))
+	if user != "user" || pass != "secret" {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// CONNECT to an IPv4 address or a name.
+	req := next(4)
+	var host string
+	switch req[3] {
+	case 1:
+		host = net.IP(next(4)).String()
+	case 3:
+		host = string(next(int(next(1)[0])))
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	port := binary.BigEndian.Uint16(next(2))
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	relay(struct {
+		io.Reader
+		io.Writer
+	}{br, conn}, net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Route sends requests whose path starts with Prefix to Target instead of
+// the default local service.
+type Route struct {
+	Prefix      string
+	Target      Target
+	StripPrefix bool // remove Prefix from the path before forwarding
+}
+
+// ParseRoute parses a route of the form "PREFIX=TARGET[,strip]", where
+// TARGET is anything ParseTarget accepts, e.g. "/api=8000,strip".
+func ParseRoute(s string) (Route, error) {
+	prefix, rest, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return Route{}, fmt.Errorf("invalid route %q: want /prefix=target", s)
+	}
+
+	var r Route
+	if spec, opt, ok := strings.Cut(rest, ","); ok {
+		if opt != "strip" {
+			return Route{}, fmt.Errorf("invalid route %q: unknown option %q", s, opt)
+		}
+		rest = spec
+		r.StripPrefix = true
+	}
+
+	target, err := ParseTarget(rest)
+	if err != nil {
+		return Route{}, fmt.Errorf("invalid route %q: %w", s, err)
+	}
+	r.Prefix = prefix
+	r.Target = target
+	return r, nil
+}
+
+// matches reports whether path falls under the route's prefix, on a path
+// segment boundary so "/api" matches "/api/users" but not "/apiary".
+func (r Route) matches(path string) bool {
+	prefix := strings.TrimSuffix(r.Prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// upstream is a local service with the transport used to reach it.
+type upstream struct {
+	Route
+	transport *http.Transport
+}
+
+// buildUpstreams returns the configured routes followed by the default
+// local service, longest prefix first so the most specific route wins.
+func buildUpstreams(cfg Config) ([]upstream, error) {
+	routes := append([]Route(nil), cfg.Routes...)
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].Prefix) > len(routes[j].Prefix) })
+	routes = append(routes, Route{
+		Prefix: "/",
+		Target: Target{Network: cfg.LocalNetwork, Scheme: cfg.LocalScheme, Addr: cfg.LocalAddr},
+	})
+
+	ups := make([]upstream, 0, len(routes))
+	for _, r := range routes {
+		transport, err := newTransport(cfg, r.Target)
+		if err != nil {
+			return nil, err
+		}
+		ups = append(ups, upstream{Route: r, transport: transport})
+	}
+	return ups, nil
+}
+
+// route picks the upstream for req and points req at it.
+func (c *Client) route(req *http.Request) upstream {
+	up := c.upstreams[len(c.upstreams)-1]
+	for _, u := range c.upstreams {
+		if u.matches(req.URL.Path) {
+			up = u
+			break
+		}
+	}
+
+	if up.StripPrefix {
+		prefix := strings.TrimSuffix(up.Prefix, "/")
+		req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+		if req.URL.RawPath != "" {
+			// The prefix matched the unescaped path; the raw one holds it
+			// escaped, e.g. "/my%20docs" for "/my docs".
+			escaped := (&url.URL{Path: prefix}).EscapedPath()
+			req.URL.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.RawPath, escaped), "/")
+		}
+	}
+
+	req.URL.Scheme = up.Target.Scheme
+	req.URL.Host = up.Target.host()
+	switch c.cfg.HostHeader {
+	case HostPreserve:
+	case HostRewrite:
+		req.Host = up.Target.host()
+	default:
+		req.Host = c.cfg.HostHeader
+	}
+	return up
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Route
+	}{
+		{"/api=8000", Route{Prefix: "/api", Target: Target{"tcp", "http", "localhost:8000"}}},
+		{"/api=8000,strip", Route{Prefix: "/api", Target: Target{"tcp", "http", "localhost:8000"}, StripPrefix: true}},
+		{"/=https://localhost:8443", Route{Prefix: "/", Target: Target{"tcp", "https", "localhost:8443"}}},
+		{"/ws=unix:///tmp/ws.sock", Route{Prefix: "/ws", Target: Target{"unix", "http", "/tmp/ws.sock"}}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRoute(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRoute(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"/api",
+		"api=8000",
+		"/api=",
+		"/api=8000,rewrite",
+		"/api=localhost",
+	} {
+		if got, err := ParseRoute(in); err == nil {
+			t.Errorf("ParseRoute(%q) = %+v, want an error", in, got)
+		}
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{"/api", "/api", true},
+		{"/api", "/api/users", true},
+		{"/api/", "/api/users", true},
+		{"/api", "/apiary", false},
+		{"/api", "/", false},
+		{"/", "/anything", true},
+	}
+	for _, tt := range tests {
+		if got := (Route{Prefix: tt.prefix}).matches(tt.path); got != tt.want {
+			t.Errorf("Route{Prefix: %q}.matches(%q) = %v, want %v", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	routes := []Route{
+		{Prefix: "/api", Target: Target{"tcp", "http", "localhost:8000"}, StripPrefix: true},
+		// Listed after the shorter prefix it falls under, but still wins.
+		{Prefix: "/api/v2", Target: Target{"tcp", "http", "localhost:8002"}},
+		{Prefix: "/my docs", Target: Target{"tcp", "http", "localhost:8003"}, StripPrefix: true},
+		{Prefix: "/ws", Target: Target{"unix", "http", "/tmp/ws.sock"}},
+	}
+	tests := []struct {
+		host    string // Config.HostHeader
+		target  string
+		addr    string // the upstream picked
+		path    string // escaped, as sent upstream
+		reqHost string
+	}{
+		{HostPreserve, "/", "localhost:3000", "/", "app.example.com"},
+		{HostPreserve, "/apiary", "localhost:3000", "/apiary", "app.example.com"},
+		{HostPreserve, "/api", "localhost:8000", "/", "app.example.com"},
+		{HostPreserve, "/api/", "localhost:8000", "/", "app.example.com"},
+		{HostPreserve, "/api/users?page=2", "localhost:8000", "/users", "app.example.com"},
+		{HostPreserve, "/api/files/a%2Fb", "localhost:8000", "/files/a%2Fb", "app.example.com"},
+		{HostPreserve, "/api/v2/users", "localhost:8002", "/api/v2/users", "app.example.com"},
+		{HostPreserve, "/my%20docs/a%2Fb", "localhost:8003", "/a%2Fb", "app.example.com"},
+		{HostPreserve, "/my%20docs/notes%20v1", "localhost:8003", "/notes%20v1", "app.example.com"},
+		{HostRewrite, "/", "localhost:3000", "/", "localhost:3000"},
+		{HostRewrite, "/api/users", "localhost:8000", "/users", "localhost:8000"},
+		{HostRewrite, "/api/v2/users", "localhost:8002", "/api/v2/users", "localhost:8002"},
+		{HostRewrite, "/ws", "/tmp/ws.sock", "/ws", "localhost"},
+		{"api.internal", "/api/v2", "localhost:8002", "/api/v2", "api.internal"},
+	}
+	for _, tt := range tests {
+		cfg := Config{LocalNetwork: "tcp", LocalScheme: "http", LocalAddr: "localhost:3000", Routes: routes, HostHeader: tt.host}
+		ups, err := buildUpstreams(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Client{cfg: cfg, upstreams: ups}
+
+		req := httptest.NewRequest("GET", "http://app.example.com"+tt.target, nil)
+		up := c.route(req)
+		if up.Target.Addr != tt.addr || req.URL.EscapedPath() != tt.path || req.Host != tt.reqHost {
+			t.Errorf("%s with Host %s: went to %s%s with Host %s, want %s%s with Host %s",
+				tt.target, tt.host, up.Target.Addr, req.URL.EscapedPath(), req.Host, tt.addr, tt.path, tt.reqHost)
+		}
+		if req.URL.Scheme != "http" || req.URL.Host != up.Target.host() {
+			t.Errorf("%s: URL points at %s://%s, want http://%s", tt.target, req.URL.Scheme, req.URL.Host, up.Target.host())
+		}
+	}
+}
+
+func TestBuildUpstreamsOrder(t *testing.T) {
+	ups, err := buildUpstreams(Config{
+		LocalNetwork: "tcp",
+		LocalScheme:  "http",
+		LocalAddr:    "localhost:3000",
+		Routes: []Route{
+			{Prefix: "/a", Target: Target{"tcp", "http", "localhost:1"}},
+			{Prefix: "/a/b/c", Target: Target{"tcp", "http", "localhost:3"}},
+			{Prefix: "/b", Target: Target{"tcp", "http", "localhost:2"}},
+			{Prefix: "/a/b", Target: Target{"tcp", "http", "localhost:4"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, up := range ups {
+		got = append(got, up.Prefix)
+	}
+	// Longest first, equal lengths in the order given, the default last.
+	want := []string{"/a/b/c", "/a/b", "/a", "/b", "/"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Target is the local service that tunnel traffic is forwarded to.
+type Target struct {
+	Network string // "tcp" or "unix"
+	Scheme  string // "http" or "https"
+	Addr    string // host:port, or a socket path for unix
+}
+
+// ParseTarget parses the address of a local service. It accepts a bare port
+// ("3000"), which means localhost over plain HTTP, a "host:port" on another
+// machine, a URL such as "https://localhost:8443", or a Unix socket as
+// "unix:///var/run/app.sock".
+func ParseTarget(s string) (Target, error) {
+	if port, err := strconv.Atoi(s); err == nil {
+		if port < 1 || port > 65535 {
+			return Target{}, fmt.Errorf("invalid port %q", s)
+		}
+		return Target{Network: "tcp", Scheme: "http", Addr: "localhost:" + s}, nil
+	}
+
+	if path, ok := strings.CutPrefix(s, "unix://"); ok {
+		if path == "" {
+			return Target{}, fmt.Errorf("invalid target %q: missing socket path", s)
+		}
+		return Target{Network: "unix", Scheme: "http", Addr: path}, nil
+	}
+
+	if !strings.Contains(s, "://") {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil || host == "" {
+			return Target{}, fmt.Errorf("invalid target %q: want a port, host:port, URL or unix:// socket", s)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return Target{}, fmt.Errorf("invalid port in target %q", s)
+		}
+		return Target{Network: "tcp", Scheme: "http", Addr: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid target %q: %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Target{}, fmt.Errorf("invalid target %q: unsupported scheme %q", s, u.Scheme)
+	}
+	if u.Host == "" {
+		return Target{}, fmt.Errorf("invalid target %q: missing host", s)
+	}
+	if u.Path != "" && u.Path != "/" {
+		return Target{}, fmt.Errorf("invalid target %q: paths are not supported", s)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = u.Host + ":" + port
+	}
+	return Target{Network: "tcp", Scheme: u.Scheme, Addr: addr}, nil
+}
+
+// String returns the target as a URL.
+func (t Target) String() string {
+	if t.Network == "unix" {
+		return "unix://" + t.Addr
+	}
+	return t.Scheme + "://" + t.Addr
+}
+
+// host is the host used in request URLs for the target. Unix sockets have
+// none, so they are addressed as localhost.
+func (t Target) host() string {
+	if t.Network == "unix" {
+		return "localhost"
+	}
+	return t.Addr
+}
+
+// describe names the target for error messages.
+func (t Target) describe() string {
+	if t.Network == "unix" {
+		return t.Addr
+	}
+	host, port, _ := net.SplitHostPort(t.Addr)
+	if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		return "port " + port
+	}
+	return t.Addr
+}
+
+// newTransport builds the transport used to reach target.
+func newTransport(cfg Config, target Target) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = cfg.ResponseTimeout
+	// Every request goes to the same host, so keep as many connections
+	// alive as the transport allows in total instead of the default two.
+	transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+
+	if target.Network == "unix" {
+		// Requests still carry an HTTP host; every connection goes to
+		// the socket regardless of it.
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", target.Addr)
+		}
+	}
+
+	if cfg.LocalHTTP2 && target.Scheme == "http" {
+		// Cleartext HTTP/2 with prior knowledge, as gRPC servers expect.
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	if cfg.UpstreamInsecure || cfg.UpstreamCA != "" {
+		tlsCfg := &tls.Config{InsecureSkipVerify: cfg.UpstreamInsecure}
+		if cfg.UpstreamCA != "" {
+			pool, err := loadCA("upstream", cfg.UpstreamCA)
+			if err != nil {
+				return nil, err
+			}
+			tlsCfg.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsCfg
+	}
+
+	return transport, nil
+}
+
+// loadCA returns the system roots plus the certificates in the PEM file at
+// path. what names the CA in errors.
+func loadCA(what, path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s CA: %w", what, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s CA %s: no certificates found", what, path)
+	}
+	return pool, nil
+}
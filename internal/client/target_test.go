@@ -0,0 +1,43 @@
+package client
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Target
+	}{
+		{"3000", Target{"tcp", "http", "localhost:3000"}},
+		{"192.168.1.5:8080", Target{"tcp", "http", "192.168.1.5:8080"}},
+		{"[::1]:8080", Target{"tcp", "http", "[::1]:8080"}},
+		{"http://localhost:8080", Target{"tcp", "http", "localhost:8080"}},
+		{"https://localhost:8443/", Target{"tcp", "https", "localhost:8443"}},
+		{"http://app.internal", Target{"tcp", "http", "app.internal:80"}},
+		{"https://app.internal", Target{"tcp", "https", "app.internal:443"}},
+		{"unix:///var/run/app.sock", Target{"unix", "http", "/var/run/app.sock"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseTarget(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"0",
+		"65536",
+		"localhost",
+		":8080",
+		"localhost:http",
+		"localhost:0",
+		"unix://",
+		"ftp://localhost:21",
+		"http://",
+		"http://localhost:8080/api",
+	} {
+		if got, err := ParseTarget(in); err == nil {
+			t.Errorf("ParseTarget(%q) = %+v, want an error", in, got)
+		}
+	}
+}
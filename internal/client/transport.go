@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// fallbackDialTimeout bounds the TCP attempt when a WebSocket fallback is
+// configured, since firewalls often drop packets instead of refusing.
+const fallbackDialTimeout = 5 * time.Second
+
+// WebSocketURL returns the URL at which the server listening for tunnels at
+// serverAddr accepts them over a secure WebSocket on port 443, for use as
+// Config.ServerURL.
+func WebSocketURL(serverAddr string) string {
+	host, _, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		host = serverAddr
+	}
+	return (&url.URL{Scheme: "wss", Host: host, Path: tunnel.ConnectPath}).String()
+}
+
+// newServerTLS returns the TLS configuration for reaching the server over
+// QUIC or wss://.
+func newServerTLS(cfg Config) (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.ServerInsecure}
+	if cfg.ServerCA != "" {
+		pool, err := loadCA("server", cfg.ServerCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// connect dials the server and registers the tunnel, returning the open
+// connection and the server's answer. TCP to ServerAddr is tried first; a
+// WebSocket to ServerURL is the fallback when the server or the proxy
+// can't be reached that way.
+func (c *Client) connect(ctx context.Context) (net.Conn, tunnel.HandshakeResp, error) {
+	if c.cfg.ServerAddr != "" {
+		dial := c.dialTCP
+		if c.cfg.Transport == TransportQUIC {
+			dial = c.dialQUIC
+		}
+		if c.cfg.ServerURL != "" {
+			direct := dial
+			dial = func(ctx context.Context) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, fallbackDialTimeout)
+				defer cancel()
+				return direct(ctx)
+			}
+		}
+		conn, resp, err := c.register(ctx, c.cfg.ServerAddr, dial)
+		// Proxies often only let port 443 through, so their refusals
+		// fall back too.
+		unreachable := errors.Is(err, ErrServerUnreachable) || errors.Is(err, ErrProxy)
+		if err == nil || c.cfg.ServerURL == "" || !unreachable || ctx.Err() != nil {
+			return conn, resp, err
+		}
+	}
+	return c.register(ctx, c.cfg.ServerURL, c.dialWebSocket)
+}
+
+// register opens a connection with dial and sends the handshake over it.
+// addr names the server in errors.
+func (c *Client) register(ctx context.Context, addr string, dial func(context.Context) (net.Conn, error)) (net.Conn, tunnel.HandshakeResp, error) {
+	conn, err := dial(ctx)
+	if err != nil {
+		var ce *ConnectError
+		if errors.As(err, &ce) {
+			return nil, tunnel.HandshakeResp{}, err
+		}
+		return nil, tunnel.HandshakeResp{}, &ConnectError{
+			Kind:   ErrServerUnreachable,
+			Addr:   addr,
+			Detail: addr,
+		}
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return nil, tunnel.HandshakeResp{}, ErrClosed
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	typ := c.cfg.Type
+	if c.cfg.E2E {
+		typ = tunnel.TypeTLS
+	}
+	err = tunnel.SendHandshake(conn, tunnel.Handshake{
+		Version:   tunnel.ProtocolVersion,
+		Type:      typ,
+		Subdomain: c.cfg.Subdomain,
+		Token:     c.cfg.Token,
+		RateLimit: c.cfg.RateLimit,
+		RateBurst: c.cfg.RateBurst,
+
+		BandwidthLimit: c.cfg.Bandwidth,
+
+		Pool:    c.cfg.Pool,
+		Balance: c.cfg.Balance,
+		Sticky:  c.cfg.Sticky,
+
+		Domains:       c.cfg.Domains,
+		DomainRecords: c.records,
+
+		Compression: c.offerCompression(),
+		E2E:         c.cfg.E2E,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, tunnel.HandshakeResp{}, &ConnectError{
+			Kind:   ErrServerUnreachable,
+			Addr:   addr,
+			Detail: "handshake failed",
+		}
+	}
+
+	resp, err := tunnel.ReadHandshakeResp(conn)
+	if err != nil {
+		conn.Close()
+		return nil, tunnel.HandshakeResp{}, &ConnectError{
+			Kind:   ErrServerUnreachable,
+			Addr:   addr,
+			Detail: "no response from server",
+		}
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return nil, resp, c.handshakeError(resp)
+	}
+	if resp.Version != tunnel.ProtocolVersion {
+		// Servers from before versioning accept any client, then speak
+		// a protocol it does not understand.
+		conn.Close()
+		return nil, resp, &ConnectError{
+			Kind:   ErrUnsupported,
+			Addr:   addr,
+			Detail: fmt.Sprintf("server speaks protocol version %d, but op speaks %d; use a matching release", resp.Version, tunnel.ProtocolVersion),
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, resp, nil
+}
+
+func (c *Client) dialTCP(ctx context.Context) (net.Conn, error) {
+	return c.dialServer(ctx, c.cfg.ServerAddr)
+}
+
+func (c *Client) dialQUIC(ctx context.Context) (net.Conn, error) {
+	tlsCfg := c.serverTLS.Clone()
+	if host, _, err := net.SplitHostPort(c.cfg.ServerAddr); err == nil {
+		tlsCfg.ServerName = host
+	}
+	conn, err := tunnel.DialQUIC(ctx, c.cfg.ServerAddr, tlsCfg, c.cfg.StreamWindow)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialWebSocket opens a WebSocket to ServerURL and returns it as a
+// connection carrying binary frames.
+func (c *Client) dialWebSocket(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(c.cfg.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+
+	conn, err := c.dialServer(ctx, net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if u.Scheme == "wss" {
+		tlsCfg := c.serverTLS.Clone()
+		tlsCfg.ServerName = u.Hostname()
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		origin.Scheme = "https"
+	}
+	cfg, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// relayUDP serves one remote UDP peer. Datagrams from the stream go to the
+// local service through a socket dedicated to the peer, so every reply on
+// that socket belongs to it and is framed back on the same stream. The
+// server closes the stream once the peer goes idle.
+func (c *Client) relayUDP(stream net.Conn) {
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	if _, err := tunnel.ReadDatagram(stream, buf); err != nil { // peer address
+		return
+	}
+
+	local, err := net.Dial("udp", c.cfg.LocalAddr)
+	if err != nil {
+		return
+	}
+	defer local.Close()
+
+	go func() {
+		reply := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			n, err := local.Read(reply)
+			if err != nil {
+				// Nothing listening yet shows up as a refused read;
+				// keep the mapping for the next datagram.
+				if isRefused(err) {
+					continue
+				}
+				stream.Close()
+				return
+			}
+			if tunnel.WriteDatagram(stream, reply[:n]) != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		p, err := tunnel.ReadDatagram(stream, buf)
+		if err != nil {
+			return
+		}
+		local.Write(p)
+	}
+}
+
+func isRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,83 @@
+package client_test
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/openporttest"
+)
+
+// TestUpstream proxies to an https local service and reports the Host
+// header it was sent.
+func TestUpstream(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer local.Close()
+	addr := local.Listener.Addr().String()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: local.Certificate().Raw}), 0o600)
+
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	for name, tc := range map[string]struct {
+		cfg    client.Config
+		status int
+		host   string // empty for the tunnel's public host
+	}{
+		"preserve": {
+			cfg:    client.Config{UpstreamInsecure: true},
+			status: http.StatusOK,
+		},
+		"rewrite": {
+			cfg:    client.Config{UpstreamInsecure: true, HostHeader: client.HostRewrite},
+			status: http.StatusOK,
+			host:   addr,
+		},
+		"literal": {
+			cfg:    client.Config{UpstreamInsecure: true, HostHeader: "api.internal"},
+			status: http.StatusOK,
+			host:   "api.internal",
+		},
+		"custom CA": {
+			cfg:    client.Config{UpstreamCA: caFile, HostHeader: client.HostRewrite},
+			status: http.StatusOK,
+			host:   addr,
+		},
+		"untrusted certificate": {
+			status: http.StatusBadGateway,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc.cfg.LocalAddr = addr
+			tc.cfg.LocalScheme = "https"
+			tun := srv.Connect(t, nil, tc.cfg)
+
+			resp, err := srv.HTTPClient().Get(tun.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("got %d %q, want %d", resp.StatusCode, body, tc.status)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			want := tc.host
+			if want == "" {
+				want = tun.Host()
+			}
+			if string(body) != want {
+				t.Fatalf("upstream saw Host %q, want %q", body, want)
+			}
+		})
+	}
+}
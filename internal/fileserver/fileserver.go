@@ -0,0 +1,157 @@
+package fileserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Options configures the file server.
+type Options struct {
+	// SPA serves index.html for paths that don't exist, so client-side
+	// routers work on deep links.
+	SPA bool
+
+	// Listing shows the contents of directories that have no index.html.
+	// Without it those directories answer 404.
+	Listing bool
+
+	// Username and Password enable HTTP basic auth when Username is set.
+	Username string
+	Password string
+}
+
+// New returns a handler that serves the directory at root, with range
+// requests and, if opts.Listing is set, directory listings. Dotfiles and
+// symlinks leading out of root are never served.
+func New(root string, opts Options) (http.Handler, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var h http.Handler = http.FileServer(dir{root: resolved, listing: opts.Listing})
+	if opts.SPA {
+		h = spaFallback(root, h)
+	}
+	if opts.Username != "" {
+		h = basicAuth(opts.Username, opts.Password, h)
+	}
+	return h, nil
+}
+
+// dir is an http.FileSystem over root that hides what a public URL should
+// not reach: dot-prefixed names such as .git and .env, anything whose
+// symlinks resolve outside root and, without listing, directories that
+// have no index.html.
+type dir struct {
+	root    string // with symlinks resolved
+	listing bool
+}
+
+func (d dir) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(d.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	if resolved != d.root && !strings.HasPrefix(resolved, d.root+string(filepath.Separator)) {
+		return nil, fs.ErrNotExist
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() {
+		return f, nil
+	}
+	if d.listing {
+		return listing{f}, nil
+	}
+	// http.FileServer lists a directory when opening its index fails, so
+	// the index has to pass the same checks.
+	index, err := d.Open(path.Join(name, "index.html"))
+	if err != nil {
+		f.Close()
+		return nil, fs.ErrNotExist
+	}
+	index.Close()
+	return f, nil
+}
+
+// listing is a directory whose listing leaves out dotfiles.
+type listing struct {
+	http.File
+}
+
+func (l listing) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := l.File.Readdir(count)
+	shown := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			shown = append(shown, info)
+		}
+	}
+	return shown, err
+}
+
+// spaFallback rewrites requests for missing paths to /index.html. Paths
+// with a file extension are left alone so missing assets still 404.
+func spaFallback(root string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); os.IsNotExist(err) && path.Ext(name) == "" {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/"
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="openport", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ParseCredentials splits a "user:pass" pair.
+func ParseCredentials(s string) (username, password string, err error) {
+	u, p, ok := strings.Cut(s, ":")
+	if !ok || u == "" {
+		return "", "", fmt.Errorf("invalid credentials %q: want user:pass", s)
+	}
+	return u, p, nil
+}
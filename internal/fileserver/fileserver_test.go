@@ -0,0 +1,174 @@
+package fileserver_test
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nitintf/openport/internal/fileserver"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestServe(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>app</h1>"), 0o644)
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("console.log(1)"), 0o644)
+
+	for name, tc := range map[string]struct {
+		opts      fileserver.Options
+		path      string
+		auth      bool
+		status    int
+		body      string
+		byteRange string
+	}{
+		"file":             {path: "/app.js", status: http.StatusOK, body: "console.log(1)"},
+		"index":            {path: "/", status: http.StatusOK, body: "<h1>app</h1>"},
+		"range":            {path: "/app.js", byteRange: "bytes=0-6", status: http.StatusPartialContent, body: "console"},
+		"missing":          {path: "/about", status: http.StatusNotFound},
+		"spa deep link":    {opts: fileserver.Options{SPA: true}, path: "/about", status: http.StatusOK, body: "<h1>app</h1>"},
+		"spa missing file": {opts: fileserver.Options{SPA: true}, path: "/missing.js", status: http.StatusNotFound},
+		"no credentials":   {opts: fileserver.Options{Username: "u", Password: "p"}, path: "/", status: http.StatusUnauthorized},
+		"credentials":      {opts: fileserver.Options{Username: "u", Password: "p"}, path: "/", auth: true, status: http.StatusOK, body: "<h1>app</h1>"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h, err := fileserver.New(root, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tun := openporttest.Start(t, h)
+
+			req, _ := http.NewRequest(http.MethodGet, tun.URL+tc.path, nil)
+			if tc.auth {
+				req.SetBasicAuth("u", "p")
+			}
+			if tc.byteRange != "" {
+				req.Header.Set("Range", tc.byteRange)
+			}
+			resp, err := tun.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.status || (tc.body != "" && string(body) != tc.body) {
+				t.Fatalf("got %d %q, want %d %q", resp.StatusCode, body, tc.status, tc.body)
+			}
+		})
+	}
+}
+
+func TestHidden(t *testing.T) {
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644)
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "app.js"), []byte("console.log(1)"), 0o644)
+	os.WriteFile(filepath.Join(root, ".env"), []byte("TOKEN=secret"), 0o644)
+	os.Mkdir(filepath.Join(root, ".git"), 0o755)
+	os.WriteFile(filepath.Join(root, ".git", "config"), []byte("secret"), 0o644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "secret"))
+	os.Symlink(outside, filepath.Join(root, "outside"))
+	os.Symlink(filepath.Join(root, "app.js"), filepath.Join(root, "link.js"))
+
+	h, err := fileserver.New(root, fileserver.Options{SPA: true, Listing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun := openporttest.Start(t, h)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/.env", http.StatusNotFound},
+		{"/.git/config", http.StatusNotFound},
+		{"/.git/", http.StatusNotFound},
+		{"/secret", http.StatusNotFound},
+		{"/outside/secret", http.StatusNotFound},
+		{"/outside/", http.StatusNotFound},
+		// Symlinks within root still work.
+		{"/link.js", http.StatusOK},
+	} {
+		status, body := get(t, tun, tc.path)
+		if status != tc.status {
+			t.Errorf("%s: got %d, want %d", tc.path, status, tc.status)
+		}
+		if strings.Contains(body, "secret") {
+			t.Errorf("%s: body %q leaks the secret", tc.path, body)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0o644)
+	os.WriteFile(filepath.Join(root, ".env"), []byte("TOKEN=secret"), 0o644)
+
+	for name, tc := range map[string]struct {
+		opts   fileserver.Options
+		path   string
+		status int
+	}{
+		"off":            {path: "/", status: http.StatusNotFound},
+		"on":             {opts: fileserver.Options{Listing: true}, path: "/", status: http.StatusOK},
+		"spa, no index":  {opts: fileserver.Options{SPA: true}, path: "/about", status: http.StatusNotFound},
+		"spa and on":     {opts: fileserver.Options{SPA: true, Listing: true}, path: "/about", status: http.StatusOK},
+		"off, subfolder": {path: "/sub/", status: http.StatusNotFound},
+	} {
+		t.Run(name, func(t *testing.T) {
+			os.MkdirAll(filepath.Join(root, "sub"), 0o755)
+			h, err := fileserver.New(root, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tun := openporttest.Start(t, h)
+
+			status, body := get(t, tun, tc.path)
+			if status != tc.status {
+				t.Fatalf("got %d %q, want %d", status, body, tc.status)
+			}
+			if listed := strings.Contains(body, "notes.txt"); listed != (status == http.StatusOK) {
+				t.Fatalf("listing shown: %v, body %q", listed, body)
+			}
+			if strings.Contains(body, ".env") {
+				t.Fatalf("listing %q shows a dotfile", body)
+			}
+		})
+	}
+}
+
+func get(t *testing.T, tun *openporttest.Tunnel, path string) (int, string) {
+	t.Helper()
+	resp, err := tun.HTTPClient().Get(tun.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, string(body)
+}
+
+func TestNewNotADirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0o644)
+	if _, err := fileserver.New(file, fileserver.Options{}); err == nil {
+		t.Fatal("New accepted a file as root")
+	}
+	if _, err := fileserver.New(filepath.Join(file, "missing"), fileserver.Options{}); err == nil {
+		t.Fatal("New accepted a missing root")
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	if u, p, err := fileserver.ParseCredentials("admin:s3:cret"); err != nil || u != "admin" || p != "s3:cret" {
+		t.Fatalf("got %q, %q, %v", u, p, err)
+	}
+	for _, in := range []string{"", "admin", ":secret"} {
+		if _, _, err := fileserver.ParseCredentials(in); err == nil {
+			t.Errorf("ParseCredentials(%q) succeeded, want an error", in)
+		}
+	}
+}
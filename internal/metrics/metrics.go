@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds a set of metrics and renders them in the Prometheus text format.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// ServeHTTP writes every registered metric.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec registers a counter family with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: make(map[string]*Counter),
+	}
+	r.register(v)
+	return v
+}
+
+// With returns the counter for the given label values, creating it if needed.
+// Values must be passed in the order the labels were declared.
+func (v *CounterVec) With(values ...string) *Counter {
+	key := v.key(values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.counters[key] = c
+	}
+	return c
+}
+
+// Delete drops the counter for the given label values.
+func (v *CounterVec) Delete(values ...string) {
+	v.mu.Lock()
+	delete(v.counters, v.key(values))
+	v.mu.Unlock()
+}
+
+func (v *CounterVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	pairs := make([]string, len(values))
+	for i, val := range values {
+		pairs[i] = fmt.Sprintf("%s=%q", v.labels[i], val)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v *CounterVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.counters))
+	for k := range v.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(w, "%s %d\n", v.name, v.counters[k].Value())
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", v.name, k, v.counters[k].Value())
+		}
+	}
+	v.mu.Unlock()
+}
+
+// GaugeFunc reports a value computed at scrape time.
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn on every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// CounterFunc reports a counter family whose samples are gathered at scrape
+// time, for values that already live elsewhere such as per-tunnel totals.
+type CounterFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(emit func(v float64, values ...string))
+}
+
+// NewCounterFunc registers a counter family. On every scrape collect is called
+// and reports each sample through emit, with label values in declared order.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(emit func(v float64, values ...string))) *CounterFunc {
+	c := &CounterFunc{name: name, help: help, labels: labels, collect: collect}
+	r.register(c)
+	return c
+}
+
+func (c *CounterFunc) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	var lines []string
+	c.collect(func(v float64, values ...string) {
+		pairs := make([]string, len(values))
+		for i, val := range values {
+			pairs[i] = fmt.Sprintf("%s=%q", c.labels[i], val)
+		}
+		lines = append(lines, fmt.Sprintf("%s{%s} %s", c.name, strings.Join(pairs, ","), formatFloat(v)))
+	})
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
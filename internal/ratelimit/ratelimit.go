@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket. A nil *Limiter allows everything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // bucket capacity
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter that refills at rate tokens per second and holds at
+// most burst tokens. It returns nil (unlimited) when rate is not positive.
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Rate reports the refill rate in tokens per second, or 0 if unlimited.
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	return l.rate
+}
+
+// Burst reports the bucket capacity, or 0 if unlimited.
+func (l *Limiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.burst)
+}
+
+// Allow takes one token from the bucket. When the bucket is empty it returns
+// false along with how long the caller should wait before retrying.
+func (l *Limiter) Allow() (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	l.tokens = math.Min(l.burst, l.tokens+elapsed*l.rate)
+}
+
+// full reports whether the bucket has refilled completely, meaning it holds
+// no state worth keeping.
+func (l *Limiter) full(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	return l.tokens >= l.burst
+}
+
+// Keyed hands out an independent Limiter per key, such as a source IP.
+type Keyed struct {
+	rate  float64
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+	swept    time.Time
+}
+
+// sweepInterval controls how often idle buckets are dropped from a Keyed.
+const sweepInterval = time.Minute
+
+// NewKeyed returns a Keyed limiter, or nil (unlimited) when rate is not positive.
+func NewKeyed(rate float64, burst int) *Keyed {
+	if rate <= 0 {
+		return nil
+	}
+	return &Keyed{
+		rate:     rate,
+		burst:    burst,
+		limiters: make(map[string]*Limiter),
+		swept:    time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket for key.
+func (k *Keyed) Allow(key string) (bool, time.Duration) {
+	if k == nil {
+		return true, 0
+	}
+
+	k.mu.Lock()
+	now := time.Now()
+	if now.Sub(k.swept) > sweepInterval {
+		for key, l := range k.limiters {
+			if l.full(now) {
+				delete(k.limiters, key)
+			}
+		}
+		k.swept = now
+	}
+	l, ok := k.limiters[key]
+	if !ok {
+		l = New(k.rate, k.burst)
+		k.limiters[key] = l
+	}
+	k.mu.Unlock()
+
+	return l.Allow()
+}
+
+// WaitN takes n tokens, sleeping until the bucket can cover them. Requests
+// larger than the burst are allowed; they leave the bucket in debt so later
+// callers wait their share.
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
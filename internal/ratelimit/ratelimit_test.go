@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	if l := New(0, 5); l != nil {
+		t.Fatalf("New(0, 5) = %+v, want nil", l)
+	}
+	if got := New(2.5, 0).Burst(); got != 3 {
+		t.Fatalf("default burst for 2.5/s = %d, want 3", got)
+	}
+	if got := New(1, 10).Burst(); got != 10 {
+		t.Fatalf("burst = %d, want 10", got)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if ok, wait := l.Allow(); !ok || wait != 0 {
+		t.Fatalf("Allow() = %v, %s, want true, 0", ok, wait)
+	}
+	if l.Rate() != 0 || l.Burst() != 0 {
+		t.Fatalf("Rate, Burst = %v, %d, want 0, 0", l.Rate(), l.Burst())
+	}
+	start := time.Now()
+	l.WaitN(1 << 30)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("WaitN on nil limiter took %s", elapsed)
+	}
+
+	var k *Keyed
+	if ok, _ := k.Allow("203.0.113.1"); !ok {
+		t.Fatal("nil Keyed refused a request")
+	}
+}
+
+func TestAllowBurst(t *testing.T) {
+	l := New(1, 3)
+	for i := range 3 {
+		if ok, _ := l.Allow(); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait := l.Allow()
+	if ok {
+		t.Fatal("request past the burst allowed")
+	}
+	// One token at 1/s is a second away, less what has trickled in.
+	if wait <= 900*time.Millisecond || wait > time.Second {
+		t.Fatalf("wait = %s, want just under 1s", wait)
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l := New(10, 2)
+	l.Allow()
+	l.Allow()
+	if ok, _ := l.Allow(); ok {
+		t.Fatal("empty bucket allowed a request")
+	}
+
+	// A second later the bucket is full again, but holds no more than
+	// the burst.
+	l.mu.Lock()
+	l.last = l.last.Add(-time.Second)
+	l.mu.Unlock()
+	for i := range 2 {
+		if ok, _ := l.Allow(); !ok {
+			t.Fatalf("request %d after refill refused", i+1)
+		}
+	}
+	if ok, wait := l.Allow(); ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("Allow() = %v, %s, want refused for up to 100ms", ok, wait)
+	}
+}
+
+func TestWaitN(t *testing.T) {
+	l := New(1000, 10)
+	start := time.Now()
+	l.WaitN(10)
+	if elapsed := time.Since(start); elapsed > 5*time.Millisecond {
+		t.Fatalf("WaitN within the burst took %s", elapsed)
+	}
+
+	// Past the burst the caller waits for the tokens it lacks.
+	start = time.Now()
+	l.WaitN(50)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("WaitN(50) at 1000/s took %s, want about 50ms", elapsed)
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	k := NewKeyed(1, 1)
+	if ok, _ := k.Allow("a"); !ok {
+		t.Fatal("first request from a refused")
+	}
+	if ok, _ := k.Allow("a"); ok {
+		t.Fatal("second request from a allowed")
+	}
+	if ok, _ := k.Allow("b"); !ok {
+		t.Fatal("b shares a's bucket")
+	}
+
+	// Buckets that have refilled are forgotten on the next sweep.
+	k.mu.Lock()
+	for _, l := range k.limiters {
+		l.last = l.last.Add(-time.Hour)
+	}
+	k.swept = k.swept.Add(-2 * sweepInterval)
+	k.mu.Unlock()
+	k.Allow("c")
+	k.mu.Lock()
+	n := len(k.limiters)
+	k.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d buckets after the sweep, want only c's", n)
+	}
+}
@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nitintf/openport/internal/server"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestAdminStats(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{AdminAddr: ":0"})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(make([]byte, 5000))
+	}), openporttest.ClientConfig{Subdomain: "app"})
+
+	req := newRequest(t, http.MethodPost, tun.URL, strings.NewReader(strings.Repeat("x", 1000)))
+	if resp := do(t, srv.HTTPClient(), req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+
+	// The request body counts in, the response body out, each with its
+	// headers on top.
+	var tunnels []server.TunnelInfo
+	if err := json.Unmarshal(adminGet(t, srv, "/api/tunnels"), &tunnels); err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 1 {
+		t.Fatalf("listed %d tunnels, want 1", len(tunnels))
+	}
+	info := tunnels[0]
+	if info.Subdomain != "app" || info.Type != "http" || info.BytesIn < 1000 || info.BytesIn > 2000 || info.BytesOut < 5000 || info.BytesOut > 6000 {
+		t.Fatalf("got %+v", info)
+	}
+
+	metrics := string(adminGet(t, srv, "/metrics"))
+	for _, want := range []string{
+		"openport_tunnels_active 1",
+		"openport_http_requests_total 1",
+		fmt.Sprintf(`openport_tunnel_bytes_total{subdomain="app",tunnel=%q,direction="in"} %d`, info.ID, info.BytesIn),
+		fmt.Sprintf(`openport_tunnel_bytes_total{subdomain="app",tunnel=%q,direction="out"} %d`, info.ID, info.BytesOut),
+		fmt.Sprintf(`openport_bytes_total{direction="in"} %d`, info.BytesIn),
+		fmt.Sprintf(`openport_bytes_total{direction="out"} %d`, info.BytesOut),
+	} {
+		if !strings.Contains(metrics, want+"\n") {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+
+	// Traffic of a tunnel that has gone stays in the totals.
+	tun.Close()
+	<-tun.Done()
+	waitFor(t, func() bool {
+		return string(adminGet(t, srv, "/api/tunnels")) == "[]\n"
+	})
+	metrics = string(adminGet(t, srv, "/metrics"))
+	if want := fmt.Sprintf(`openport_bytes_total{direction="out"} %d`, info.BytesOut); !strings.Contains(metrics, want+"\n") {
+		t.Errorf("after the tunnel closed, metrics lack %s", want)
+	}
+}
+
+func adminGet(t *testing.T, srv *openporttest.Server, path string) []byte {
+	t.Helper()
+	resp, err := http.Get("http://" + srv.AdminAddr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %d, %v", path, resp.StatusCode, err)
+	}
+	return body
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+
+	// expiryCheckInterval is how often idle and lifetime limits are checked.
+	expiryCheckInterval = 5 * time.Second
+
+	// noticeTimeout bounds how long the server waits for a client to read a
+	// notice before closing the tunnel anyway.
+	noticeTimeout = 2 * time.Second
+)
+
+// admit checks a handshake against the auth and concurrency limits and, if it
+// passes, reserves the subdomain (unless joining a shared pool) and counts the
+// tunnel against its IP and token. It returns the response to send back when
+// the tunnel is rejected. Every admitted tunnel must be paired with a call to
+// release.
+func (s *Server) admit(subdomain, ip string, hs tunnel.Handshake) *tunnel.HandshakeResp {
+	token := hs.Token
+	if !s.validToken(token) {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeUnauthorized,
+			Error: "invalid or missing auth token",
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if hs.Pool && token == "" {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeUnauthorized,
+			Error: "shared pools require an auth token",
+		}
+	}
+	p, exists := s.pools[subdomain]
+	joining := exists && p.joinable(hs, token)
+	if (exists && !joining) || s.reserved[subdomain] {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeSubdomainTaken,
+			Error: fmt.Sprintf("subdomain %q is already in use", subdomain),
+		}
+	}
+	for _, d := range hs.Domains {
+		if owner, ok := s.domains[d]; ok && owner != subdomain {
+			return &tunnel.HandshakeResp{
+				Code:  tunnel.CodeDomainTaken,
+				Error: fmt.Sprintf("domain %q is bound to another tunnel", d),
+			}
+		}
+	}
+	if max := s.cfg.MaxTunnelsPerIP; max > 0 && s.tunnelsByIP[ip] >= max {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeTooManyTunnels,
+			Error: fmt.Sprintf("limit of %d tunnels per IP address reached", max),
+		}
+	}
+	if max := s.cfg.MaxTunnelsPerToken; max > 0 && token != "" && s.tunnelsByAuth[token] >= max {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeTooManyTunnels,
+			Error: fmt.Sprintf("limit of %d tunnels per token reached", max),
+		}
+	}
+
+	if !joining {
+		s.reserved[subdomain] = true
+	}
+	s.tunnelsByIP[ip]++
+	if token != "" {
+		s.tunnelsByAuth[token]++
+	}
+	return nil
+}
+
+// release gives back the IP and token slots taken by admit.
+func (s *Server) release(ip, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tunnelsByIP[ip]--; s.tunnelsByIP[ip] <= 0 {
+		delete(s.tunnelsByIP, ip)
+	}
+	if token != "" {
+		if s.tunnelsByAuth[token]--; s.tunnelsByAuth[token] <= 0 {
+			delete(s.tunnelsByAuth, token)
+		}
+	}
+}
+
+// unreserve frees a subdomain whose handshake failed after admit.
+func (s *Server) unreserve(subdomain string) {
+	s.mu.Lock()
+	delete(s.reserved, subdomain)
+	s.mu.Unlock()
+}
+
+func (s *Server) validToken(token string) bool {
+	if len(s.cfg.AuthTokens) == 0 {
+		return true
+	}
+	for _, t := range s.cfg.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// watchExpiry closes t once it has been idle or alive for too long. The
+// returned func stops the watcher.
+func (s *Server) watchExpiry(t *tunnel.Tunnel) (stop func()) {
+	done := make(chan struct{})
+	if s.cfg.IdleTimeout <= 0 && s.cfg.MaxTunnelLifetime <= 0 {
+		return func() {}
+	}
+
+	go func() {
+		ticker := time.NewTicker(expiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			switch {
+			case s.cfg.MaxTunnelLifetime > 0 && time.Since(t.Created) >= s.cfg.MaxTunnelLifetime:
+				s.expire(t, tunnel.Notice{
+					Code:    tunnel.CodeLifetimeExceeded,
+					Message: fmt.Sprintf("tunnels are limited to %s", s.cfg.MaxTunnelLifetime),
+				})
+				return
+			case s.cfg.IdleTimeout > 0 && t.InFlight.Load() == 0 && t.IdleFor() >= s.cfg.IdleTimeout:
+				s.expire(t, tunnel.Notice{
+					Code:    tunnel.CodeIdleTimeout,
+					Message: fmt.Sprintf("closed after %s without traffic", s.cfg.IdleTimeout),
+				})
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// expire tells the client why its tunnel is being closed, then closes it.
+func (s *Server) expire(t *tunnel.Tunnel, n tunnel.Notice) {
+	log.Printf("tunnel expired: %s (%s)", t.Subdomain, n.Code)
+
+	if stream, err := t.Session.Open(); err == nil {
+		stream.SetDeadline(time.Now().Add(noticeTimeout))
+		if tunnel.WriteStreamKind(stream, tunnel.StreamNotice) == nil &&
+			json.NewEncoder(stream).Encode(n) == nil {
+			// Wait for the client to hang up so the notice isn't lost
+			// when the session closes.
+			io.Copy(io.Discard, stream)
+		}
+		stream.Close()
+	}
+
+	t.Session.Close()
+	t.Conn.Close()
+}
+
+func connIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
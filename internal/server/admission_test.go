@@ -0,0 +1,105 @@
+package server_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/tunnel"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestTunnelsPerIP(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{MaxTunnelsPerIP: 1})
+	srv.Connect(t, http.NotFoundHandler(), openporttest.ClientConfig{})
+
+	_, err := srv.TryConnect(t, http.NotFoundHandler(), openporttest.ClientConfig{})
+	if !errors.Is(err, client.ErrTooManyTunnels) {
+		t.Fatalf("second tunnel: got %v, want ErrTooManyTunnels", err)
+	}
+}
+
+func TestTunnelsPerToken(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{
+		AuthTokens:         []string{"alice", "bob"},
+		MaxTunnelsPerToken: 1,
+	})
+	srv.Connect(t, http.NotFoundHandler(), openporttest.ClientConfig{Token: "alice"})
+
+	_, err := srv.TryConnect(t, http.NotFoundHandler(), openporttest.ClientConfig{Token: "alice"})
+	if !errors.Is(err, client.ErrTooManyTunnels) {
+		t.Fatalf("second tunnel for the token: got %v, want ErrTooManyTunnels", err)
+	}
+	srv.Connect(t, http.NotFoundHandler(), openporttest.ClientConfig{Token: "bob"})
+}
+
+func TestTunnelExpiry(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg    openporttest.ServerConfig
+		detail string
+	}{
+		"idle":     {cfg: openporttest.ServerConfig{IdleTimeout: time.Second}, detail: "without traffic"},
+		"lifetime": {cfg: openporttest.ServerConfig{MaxTunnelLifetime: time.Second}, detail: "limited to 1s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Limits are checked every few seconds, so wait side by side.
+			t.Parallel()
+			srv := openporttest.NewServer(t, tc.cfg)
+			tun := srv.Connect(t, http.NotFoundHandler(), openporttest.ClientConfig{})
+
+			select {
+			case <-tun.Done():
+			case <-time.After(10 * time.Second):
+				t.Fatal("tunnel outlived its limit")
+			}
+			var ce *client.ConnectError
+			if err := tun.Err(); !errors.Is(err, client.ErrTunnelExpired) || !errors.As(err, &ce) || !strings.Contains(ce.Detail, tc.detail) {
+				t.Fatalf("got %v, want ErrTunnelExpired saying %q", err, tc.detail)
+			}
+		})
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+
+	// A client from before versioning sends none.
+	conn, err := net.Dial("tcp", srv.TunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tunnel.SendHandshake(conn, tunnel.Handshake{Subdomain: "old"})
+	resp, err := tunnel.ReadHandshakeResp(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != tunnel.CodeUnsupported || !strings.Contains(resp.Error, "protocol version 0") {
+		t.Fatalf("old client: got %q %q, want %s", resp.Code, resp.Error, tunnel.CodeUnsupported)
+	}
+
+	// So does a server from before versioning, which takes anyone.
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	go func() {
+		conn, err := old.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tunnel.ReadHandshake(conn)
+		tunnel.SendHandshakeResp(conn, tunnel.HandshakeResp{Subdomain: "app", URL: "http://app.localhost"})
+		conn.Read(make([]byte, 1))
+	}()
+	_, err = srv.TryConnect(t, http.NotFoundHandler(), openporttest.ClientConfig{ServerAddr: old.Addr().String()})
+	if !errors.Is(err, client.ErrUnsupported) {
+		t.Fatalf("old server: got %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nitintf/openport/internal/tunnel"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// verifyTimeout bounds the DNS lookups made while checking custom domains.
+const verifyTimeout = 5 * time.Second
+
+// Resolver looks up DNS TXT records for domain verification. *net.Resolver
+// satisfies it; local setups can point it at their own DNS server.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// verifyDomains normalizes the custom domains in a handshake and checks that
+// each carries the TXT record for the client's token. It returns the
+// response to send back when a domain is rejected.
+func (s *Server) verifyDomains(hs *tunnel.Handshake) *tunnel.HandshakeResp {
+	if len(hs.Domains) == 0 {
+		return nil
+	}
+	if rej := s.checkDomains(hs); rej != nil {
+		return rej
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+	defer cancel()
+
+	for _, host := range hs.Domains {
+		want := tunnel.DomainVerification(s.domainKey, hs.Token, host)
+		records, err := s.resolver().LookupTXT(ctx, tunnel.DomainRecordPrefix+host)
+		if err != nil && !isNotFound(err) {
+			return &tunnel.HandshakeResp{
+				Code:  tunnel.CodeDomainUnverified,
+				Error: fmt.Sprintf("looking up TXT record for %s: %v", host, err),
+			}
+		}
+		if !contains(records, want) {
+			return &tunnel.HandshakeResp{
+				Code:  tunnel.CodeDomainUnverified,
+				Error: fmt.Sprintf("%s has no TXT record %q", tunnel.DomainRecordPrefix+host, want),
+			}
+		}
+	}
+	return nil
+}
+
+// domainRecords answers a handshake asking for the TXT record values of its
+// domains. Only the holder of a token can learn the values for it.
+func (s *Server) domainRecords(hs tunnel.Handshake) tunnel.HandshakeResp {
+	if rej := s.checkDomains(&hs); rej != nil {
+		return *rej
+	}
+	resp := tunnel.HandshakeResp{Version: tunnel.ProtocolVersion}
+	for _, host := range hs.Domains {
+		resp.DomainRecords = append(resp.DomainRecords, tunnel.DomainVerification(s.domainKey, hs.Token, host))
+	}
+	return resp
+}
+
+// checkDomains checks that the client may use custom domains and normalizes
+// those in the handshake.
+func (s *Server) checkDomains(hs *tunnel.Handshake) *tunnel.HandshakeResp {
+	if !s.cfg.CustomDomains {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeDomainUnverified,
+			Error: "custom domains are not enabled on this server",
+		}
+	}
+	if hs.Token == "" {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeUnauthorized,
+			Error: "custom domains require an auth token",
+		}
+	}
+	// Check the token before making lookups on behalf of the client.
+	if !s.validToken(hs.Token) {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeUnauthorized,
+			Error: "invalid or missing auth token",
+		}
+	}
+
+	for i, d := range hs.Domains {
+		host, err := s.normalizeDomain(d)
+		if err != nil {
+			return &tunnel.HandshakeResp{
+				Code:  tunnel.CodeDomainUnverified,
+				Error: err.Error(),
+			}
+		}
+		hs.Domains[i] = host
+	}
+	return nil
+}
+
+// domainKey returns key as bytes, or a random key when it is empty.
+func domainKey(key string) []byte {
+	if key != "" {
+		return []byte(key)
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	log.Printf("custom domains: no domain key given, using a random one; TXT records stop matching when the server restarts")
+	return b
+}
+
+// normalizeDomain lowercases a custom domain and rejects anything that is
+// not a plain hostname outside the server's own domain.
+func (s *Server) normalizeDomain(d string) (string, error) {
+	host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+	if host == "" || strings.ContainsAny(host, ":/ ") || !strings.Contains(host, ".") {
+		return "", fmt.Errorf("invalid domain %q", d)
+	}
+	if host == s.cfg.Domain || strings.HasSuffix(host, "."+s.cfg.Domain) {
+		return "", fmt.Errorf("%s is under the server domain; use --subdomain instead", host)
+	}
+	return host, nil
+}
+
+func (s *Server) resolver() Resolver {
+	if s.cfg.Resolver != nil {
+		return s.cfg.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// bindDomains maps custom domains to subdomain. It fails without binding
+// anything if one of them already belongs to another subdomain. The caller
+// must hold mu.
+func (s *Server) bindDomains(subdomain string, domains []string) bool {
+	for _, d := range domains {
+		if owner, ok := s.domains[d]; ok && owner != subdomain {
+			return false
+		}
+	}
+	for _, d := range domains {
+		s.domains[d] = subdomain
+	}
+	return true
+}
+
+// unbindDomains drops every custom domain mapped to subdomain. The caller
+// must hold mu.
+func (s *Server) unbindDomains(subdomain string) {
+	for d, owner := range s.domains {
+		if owner == subdomain {
+			delete(s.domains, d)
+		}
+	}
+}
+
+// lookupSubdomain resolves a request host to a subdomain, either directly
+// under the server domain or through a bound custom domain.
+func (s *Server) lookupSubdomain(host string) string {
+	if sub := extractSubdomain(host, s.cfg.Domain); sub != "" {
+		return sub
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.domains[strings.ToLower(host)]
+}
+
+// domainURL is the public URL of a bound custom domain.
+func (s *Server) domainURL(host string) string {
+	if s.certs != nil {
+		return "https://" + host + portSuffix(s.cfg.TLSAddr, "443")
+	}
+	return "http://" + host + portSuffix(s.cfg.Addr, "80")
+}
+
+// e2eURL is the public URL of host on an end-to-end encrypted tunnel, which
+// visitors reach on the passthrough listener.
+func (s *Server) e2eURL(host string) string {
+	return "https://" + host + portSuffix(s.cfg.TLSPassthroughAddr, "443")
+}
+
+// isE2E reports whether host belongs to an end-to-end encrypted tunnel. Its
+// client gets its own certificate, so the server must not answer ACME
+// challenges for it or hold one.
+func (s *Server) isE2E(host string) bool {
+	subdomain := s.lookupSubdomain(host)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.pools[subdomain]
+	return ok && p.e2e
+}
+
+// redirectE2E sends a plain HTTP visitor of an end-to-end encrypted tunnel to
+// base, its https:// URL, keeping the path and query.
+func redirectE2E(w http.ResponseWriter, r *http.Request, base string) {
+	http.Redirect(w, r, base+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// hostname strips the port from a request host.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// portSuffix returns ":port" for addr, or nothing for the scheme's default.
+func portSuffix(addr, defaultPort string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == defaultPort {
+		return ""
+	}
+	return ":" + port
+}
+
+// newCertManager builds the ACME manager that issues certificates on demand
+// for bound custom domains.
+func (s *Server) newCertManager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Email:  s.cfg.ACMEEmail,
+		HostPolicy: func(_ context.Context, host string) error {
+			s.mu.RLock()
+			_, ok := s.domains[host]
+			s.mu.RUnlock()
+			if !ok {
+				return fmt.Errorf("openport: no tunnel bound to %q", host)
+			}
+			if s.isE2E(host) {
+				return fmt.Errorf("openport: %q is end-to-end encrypted", host)
+			}
+			return nil
+		},
+	}
+	if s.cfg.CertDir != "" {
+		m.Cache = autocert.DirCache(s.cfg.CertDir)
+	}
+	if s.cfg.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: s.cfg.ACMEDirectory}
+	}
+	return m
+}
+
+// challengeHandler answers ACME HTTP-01 challenges on the public listener
+// and passes everything else, including challenges for end-to-end encrypted
+// tunnels, to next.
+func (s *Server) challengeHandler(next http.Handler) http.Handler {
+	if s.certs == nil {
+		return next
+	}
+	acme := s.certs.HTTPHandler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isE2E(r.Host) {
+			// The tunnel client answers its own challenges.
+			next.ServeHTTP(w, r)
+			return
+		}
+		acme.ServeHTTP(w, r)
+	})
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if strings.TrimSpace(s) == v {
+			return true
+		}
+	}
+	return false
+}
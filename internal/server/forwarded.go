@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwardingHeaders are stripped from requests that don't come through a
+// trusted proxy, since anyone can set them.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, e := range entries {
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", e, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", e, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func (s *Server) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range s.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the visitor. Requests from trusted proxies
+// are attributed to the right-most untrusted hop in X-Forwarded-For.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !s.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// setForwardedHeaders records the original client, host and scheme on r
+// before it is written into the tunnel, both as X-Forwarded-* and as an
+// RFC 7239 Forwarded element. Values from untrusted peers are discarded.
+func (s *Server) setForwardedHeaders(r *http.Request) {
+	peer := remoteIP(r)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	if !s.trusted(peer) {
+		for _, h := range forwardingHeaders {
+			r.Header.Del(h)
+		}
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+peer)
+	} else {
+		r.Header.Set("X-Forwarded-For", peer)
+	}
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), quoteForwarded(r.Host), proto)
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		r.Header.Set("Forwarded", strings.Join(prior, ", ")+", "+element)
+	} else {
+		r.Header.Set("Forwarded", element)
+	}
+}
+
+// forwardedNode formats an IP as an RFC 7239 node, bracketing and quoting
+// IPv6 addresses.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwarded quotes v if it contains characters not allowed in an
+// RFC 7230 token, such as the colon in host:port.
+func quoteForwarded(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
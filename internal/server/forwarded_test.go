@@ -0,0 +1,56 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	for name, tc := range map[string]struct {
+		trusted []string
+		// What the local service sees; the server's own Forwarded
+		// element follows prior.
+		forwardedFor string
+		proto        string
+		prior        string
+	}{
+		"untrusted peer": {
+			forwardedFor: "127.0.0.1",
+			proto:        "http",
+		},
+		"trusted proxy": {
+			trusted:      []string{"127.0.0.0/8"},
+			forwardedFor: "203.0.113.7, 127.0.0.1",
+			proto:        "https",
+			prior:        "for=203.0.113.7, ",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := make(chan http.Header, 1)
+			srv := openporttest.NewServer(t, openporttest.ServerConfig{TrustedProxies: tc.trusted})
+			tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got <- r.Header.Clone()
+			}), openporttest.ClientConfig{})
+
+			req := newRequest(t, http.MethodGet, tun.URL, nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("Forwarded", "for=203.0.113.7")
+			do(t, srv.HTTPClient(), req)
+
+			h := <-got
+			for k, want := range map[string]string{
+				"X-Forwarded-For":   tc.forwardedFor,
+				"X-Forwarded-Proto": tc.proto,
+				"X-Forwarded-Host":  tun.Host(),
+				"Forwarded":         tc.prior + `for=127.0.0.1;host="` + tun.Host() + `";proto=http`,
+			} {
+				if h.Get(k) != want {
+					t.Errorf("%s: got %q, want %q", k, h.Get(k), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestRateLimit(t *testing.T) {
+	var served atomic.Int32
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{RateLimit: 1, RateBurst: 2})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+	}), openporttest.ClientConfig{})
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodGet, tun.URL, nil))
+		if resp.StatusCode != want {
+			t.Fatalf("request %d: got %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "1" {
+			t.Fatalf("Retry-After %q, want 1", resp.Header.Get("Retry-After"))
+		}
+	}
+	// The limited request never reached the tunnel.
+	if n := served.Load(); n != 2 {
+		t.Fatalf("local service saw %d requests, want 2", n)
+	}
+}
+
+func TestIPRateLimit(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{
+		IPRateLimit:    1,
+		IPRateBurst:    1,
+		TrustedProxies: []string{"127.0.0.1"},
+	})
+	tun := srv.Connect(t, http.NotFoundHandler(), openporttest.ClientConfig{})
+
+	// Behind a trusted proxy, each visitor has a bucket of its own.
+	for i, tc := range []struct {
+		ip   string
+		want int
+	}{
+		{"203.0.113.1", http.StatusNotFound},
+		{"203.0.113.1", http.StatusTooManyRequests},
+		{"203.0.113.2", http.StatusNotFound},
+	} {
+		req := newRequest(t, http.MethodGet, tun.URL, nil)
+		req.Header.Set("X-Forwarded-For", tc.ip)
+		if resp := do(t, srv.HTTPClient(), req); resp.StatusCode != tc.want {
+			t.Fatalf("request %d from %s: got %d, want %d", i+1, tc.ip, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	const limit = 64 << 10
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{BandwidthLimit: limit})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2*limit))
+	}), openporttest.ClientConfig{})
+
+	// The first second's worth passes at once, the rest at the limit.
+	start := time.Now()
+	resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodGet, tun.URL, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("%d bytes took %s at %d bytes per second", 2*limit, elapsed, limit)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	var served atomic.Int32
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{MaxRequestBody: 1000})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		io.Copy(io.Discard, r.Body)
+	}), openporttest.ClientConfig{})
+
+	for name, body := range map[string]io.Reader{
+		"content length": strings.NewReader(strings.Repeat("x", 2000)),
+		// Hiding the length makes the request chunked.
+		"chunked": io.MultiReader(strings.NewReader(strings.Repeat("x", 2000))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodPost, tun.URL, body))
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("got %d, want 413", resp.StatusCode)
+			}
+		})
+	}
+	if n := served.Load(); n > 1 {
+		t.Fatalf("local service saw %d requests, want at most the chunked one", n)
+	}
+
+	resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodPost, tun.URL, strings.NewReader(strings.Repeat("x", 1000))))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("body at the limit: got %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestResponseBodyLimit(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{MaxResponseBody: 1000})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(strings.Repeat("x", 2000))
+		if r.URL.Path == "/stream" {
+			// Flushing first leaves the length unknown.
+			w.(http.Flusher).Flush()
+		}
+		w.Write(body)
+	}), openporttest.ClientConfig{})
+
+	resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodGet, tun.URL+"/", nil))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("with a length: got %d, want 502", resp.StatusCode)
+	}
+
+	// Once the status is out, the connection is cut.
+	resp, err := srv.HTTPClient().Get(tun.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Fatalf("streamed: read %d bytes with no error, want the body cut off", len(body))
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{ResponseTimeout: 100 * time.Millisecond})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}), openporttest.ClientConfig{})
+	defer close(release)
+
+	if resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodGet, tun.URL, nil)); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("got %d, want 504", resp.StatusCode)
+	}
+}
+
+func newRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// do sends req and returns the response with its body read and closed.
+func do(t *testing.T, c *http.Client, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
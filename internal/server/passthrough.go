@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// clientHelloTimeout bounds how long a TLS client may take to send its
+// ClientHello on the passthrough listener.
+const clientHelloTimeout = 10 * time.Second
+
+// UsePassthrough makes Serve accept connections for TLS tunnels on l
+// instead of listening on TLSPassthroughAddr, whose port still appears in
+// tunnel URLs. Tests use it to listen on an ephemeral port. It must be
+// called before Serve.
+func (s *Server) UsePassthrough(l net.Listener) {
+	s.mu.Lock()
+	s.passthrough = l
+	s.mu.Unlock()
+}
+
+func (s *Server) acceptPassthrough(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("tls passthrough accept error: %v", err)
+			return
+		}
+		go s.handlePassthrough(conn)
+	}
+}
+
+// handlePassthrough routes a TLS connection to the tunnel named by its SNI
+// and relays it without decrypting. The local service terminates TLS.
+func (s *Server) handlePassthrough(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello, err := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("tls passthrough from %s: %v", connIP(conn), err)
+		return
+	}
+
+	if ok, _ := s.ipLimiter.Allow(connIP(conn)); !ok {
+		s.limited.With("ip").Inc()
+		return
+	}
+
+	subdomain := s.lookupSubdomain(serverName)
+	s.mu.RLock()
+	p, ok := s.pools[subdomain]
+	var t *tunnel.Tunnel
+	if ok && p.kind == tunnel.TypeTLS {
+		t = p.pick(nil, nil)
+	}
+	s.mu.RUnlock()
+	if t == nil {
+		log.Printf("tls passthrough: no tunnel for %q", serverName)
+		return
+	}
+
+	// As for HTTP, pool members over their rate limit are passed over and
+	// those that can't open a stream are dropped, until one takes the
+	// connection.
+	var raw net.Conn
+	var failed []*tunnel.Tunnel
+	var limited bool
+	for {
+		if ok, _ := t.Limiter.Allow(); !ok {
+			limited = true
+		} else {
+			if raw, err = t.Session.Open(); err == nil {
+				break
+			}
+			log.Printf("open stream error for %s (%s): %v", subdomain, t.ID, err)
+			if !errors.Is(err, tunnel.ErrGoAway) {
+				t.Session.Close()
+			}
+		}
+		failed = append(failed, t)
+
+		s.mu.RLock()
+		t = p.pick(nil, failed)
+		s.mu.RUnlock()
+		if t == nil {
+			if limited {
+				s.limited.With("tunnel").Inc()
+			}
+			return
+		}
+	}
+	defer raw.Close()
+	s.connections.With(tunnel.TypeTLS).Inc()
+
+	t.InFlight.Add(1)
+	defer t.InFlight.Add(-1)
+	t.Touch()
+	defer t.Touch()
+
+	stream := tunnel.Meter(raw, &t.Stats.BytesOut, &t.Stats.BytesIn, t.Bandwidth)
+	if err := tunnel.WriteStreamKind(stream, tunnel.StreamTLS); err != nil {
+		return
+	}
+	if _, err := stream.Write(hello); err != nil {
+		return
+	}
+	tunnel.Relay(conn, stream)
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// readClientHello reads a TLS ClientHello from conn and returns its SNI
+// server name along with the bytes consumed, which must be replayed to the
+// endpoint that terminates TLS.
+func readClientHello(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	err := tls.Server(helloConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, fmt.Errorf("reading client hello: %w", err)
+	}
+	if serverName == "" {
+		return "", nil, errors.New("client hello has no server name")
+	}
+	return serverName, buf.Bytes(), nil
+}
+
+// helloConn feeds a TLS handshake from r and discards anything written, so
+// the ClientHello can be parsed without answering it.
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,63 @@
+package server_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestTLSPassthrough(t *testing.T) {
+	local := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure "+r.URL.Path)
+	}))
+	defer local.Close()
+
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{TLSPassthroughAddr: ":0"})
+	tun := srv.Connect(t, nil, openporttest.ClientConfig{
+		Type:      "tls",
+		Subdomain: "secure",
+		LocalAddr: local.Listener.Addr().String(),
+	})
+	_, port, _ := net.SplitHostPort(srv.PassthroughAddr)
+	host := "secure." + openporttest.Domain + ":" + port
+	if tun.URL != "tls://"+host {
+		t.Fatalf("tunnel URL %s, want tls://%s", tun.URL, host)
+	}
+
+	// The local service's own certificate comes back, so the server
+	// relayed the handshake instead of terminating it.
+	visitor := &http.Client{Transport: &http.Transport{
+		DialContext:     srv.DialContext,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	defer visitor.CloseIdleConnections()
+	resp, err := visitor.Get("https://" + host + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "secure /hello" {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "secure /hello")
+	}
+	if !resp.TLS.PeerCertificates[0].Equal(local.Certificate()) {
+		t.Fatal("visitor was not given the local service's certificate")
+	}
+
+	// A name no tunnel serves gets no handshake.
+	conn, err := srv.DialContext(context.Background(), "tcp", srv.PassthroughAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := tls.Client(conn, &tls.Config{ServerName: "missing." + openporttest.Domain, InsecureSkipVerify: true})
+	if err := tc.Handshake(); err == nil {
+		t.Fatal("handshake for an unknown name succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// stickyCookie pins a visitor to one pool member.
+const stickyCookie = "openport_sticky"
+
+// pool is the set of tunnels registered under one subdomain. Most subdomains
+// have a single member; clients that opt in can share one, provided they
+// present the same auth token.
+type pool struct {
+	subdomain string
+	kind      string // tunnel type, tunnel.TypeHTTP or tunnel.TypeTLS
+	e2e       bool   // a TLS tunnel whose clients serve HTTP themselves
+	shared    bool
+	token     string
+	balance   string
+	sticky    bool
+
+	// members is guarded by Server.mu.
+	members []*tunnel.Tunnel
+	next    atomic.Uint64
+}
+
+func newPool(subdomain, token string, hs tunnel.Handshake) *pool {
+	balance := hs.Balance
+	if balance == "" {
+		balance = tunnel.BalanceRoundRobin
+	}
+	return &pool{
+		subdomain: subdomain,
+		kind:      tunnelType(hs),
+		e2e:       hs.E2E,
+		shared:    hs.Pool,
+		token:     token,
+		balance:   balance,
+		sticky:    hs.Sticky,
+	}
+}
+
+// joinable reports whether a client presenting token may add a member.
+func (p *pool) joinable(hs tunnel.Handshake, token string) bool {
+	return p.shared && hs.Pool && token != "" && token == p.token && p.kind == tunnelType(hs) && p.e2e == hs.E2E
+}
+
+// tunnelType returns the type a handshake asks for, defaulting to HTTP.
+func tunnelType(hs tunnel.Handshake) string {
+	if hs.Type == "" {
+		return tunnel.TypeHTTP
+	}
+	return hs.Type
+}
+
+func (p *pool) remove(t *tunnel.Tunnel) {
+	p.members = slices.DeleteFunc(p.members, func(m *tunnel.Tunnel) bool { return m == t })
+}
+
+// pick chooses the member to handle r, skipping any in exclude. r is nil for
+// connections that are not HTTP. The caller must hold Server.mu for reading.
+func (p *pool) pick(r *http.Request, exclude []*tunnel.Tunnel) *tunnel.Tunnel {
+	var live []*tunnel.Tunnel
+	for _, m := range p.members {
+		if !m.Session.IsClosed() && !slices.Contains(exclude, m) {
+			live = append(live, m)
+		}
+	}
+	if len(live) == 0 {
+		return nil
+	}
+
+	if p.sticky && r != nil {
+		if c, err := r.Cookie(stickyCookie); err == nil {
+			for _, m := range live {
+				if m.ID == c.Value {
+					return m
+				}
+			}
+		}
+	}
+
+	if p.balance == tunnel.BalanceLeastInFlight {
+		best := live[0]
+		for _, m := range live[1:] {
+			if m.InFlight.Load() < best.InFlight.Load() {
+				best = m
+			}
+		}
+		return best
+	}
+	return live[p.next.Add(1)%uint64(len(live))]
+}
+
+// setSticky pins the visitor to t for later requests.
+func (p *pool) setSticky(w http.ResponseWriter, t *tunnel.Tunnel) {
+	if !p.sticky {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stickyCookie,
+		Value:    t.ID,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,151 @@
+package server_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/tunnel"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestPool(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	cfg := openporttest.ClientConfig{Subdomain: "shared", Token: "secret", Pool: true}
+	a := srv.Connect(t, member("a"), cfg)
+	b := srv.Connect(t, member("b"), cfg)
+	if a.URL != b.URL {
+		t.Fatalf("members got %s and %s, want one URL", a.URL, b.URL)
+	}
+
+	if got := served(t, srv.HTTPClient(), a.URL, 4); got["a"] != 2 || got["b"] != 2 {
+		t.Fatalf("round robin served %v, want two each", got)
+	}
+
+	other := cfg
+	other.Token = "other"
+	if _, err := srv.TryConnect(t, member("c"), other); !errors.Is(err, client.ErrSubdomainTaken) {
+		t.Fatalf("joining with another token: got %v, want ErrSubdomainTaken", err)
+	}
+
+	// The pool carries on without a member that left, once the server
+	// has seen it go.
+	b.Close()
+	<-b.Done()
+	deadline := time.Now().Add(5 * time.Second)
+	for run := 0; run < 4; {
+		if time.Now().After(deadline) {
+			t.Fatal("requests still reach the member that left")
+		}
+		if status, body := fetch(t, srv.HTTPClient(), a.URL); status == http.StatusOK && body == "a" {
+			run++
+		} else {
+			run = 0
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestPoolSticky(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	cfg := openporttest.ClientConfig{Subdomain: "shared", Token: "secret", Pool: true, Sticky: true}
+	tun := srv.Connect(t, member("a"), cfg)
+	srv.Connect(t, member("b"), cfg)
+
+	jar, _ := cookiejar.New(nil)
+	hc := &http.Client{Transport: srv.HTTPClient().Transport, Jar: jar}
+	if got := served(t, hc, tun.URL, 4); len(got) != 1 {
+		t.Fatalf("a visitor with the cookie was served by %v, want one member", got)
+	}
+}
+
+func TestPoolLeastInFlight(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	cfg := openporttest.ClientConfig{Subdomain: "shared", Token: "secret", Pool: true, Balance: tunnel.BalanceLeastInFlight}
+	held := make(chan string, 1)
+	release := make(chan struct{})
+	holding := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hold" {
+				held <- name
+				<-release
+			}
+			io.WriteString(w, name)
+		})
+	}
+	tun := srv.Connect(t, holding("a"), cfg)
+	srv.Connect(t, holding("b"), cfg)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := srv.HTTPClient().Get(tun.URL + "/hold")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	busy := <-held
+	defer func() {
+		close(release)
+		<-done
+	}()
+
+	// Round robin would send every other request to the busy member.
+	if got := served(t, srv.HTTPClient(), tun.URL, 4); got[busy] != 0 {
+		t.Fatalf("with %s busy, requests were served by %v", busy, got)
+	}
+}
+
+func TestPoolRateLimited(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	cfg := openporttest.ClientConfig{Subdomain: "shared", Token: "secret", Pool: true, RateLimit: 0.01, RateBurst: 1}
+	tun := srv.Connect(t, member("a"), cfg)
+	cfg.RateBurst = 2
+	srv.Connect(t, member("b"), cfg)
+
+	// A member over its limit hands the request to one that isn't.
+	if got := served(t, srv.HTTPClient(), tun.URL, 3); got["a"] != 1 || got["b"] != 2 {
+		t.Fatalf("served %v, want a once and b twice", got)
+	}
+	// Once all are, the visitor is told to come back later.
+	resp := do(t, srv.HTTPClient(), newRequest(t, http.MethodGet, tun.URL, nil))
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("got %d with Retry-After %q, want 429 with a wait", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+// member answers every request with its name.
+func member(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+// served sends n requests to url and counts the answers by member.
+func served(t *testing.T, hc *http.Client, url string, n int) map[string]int {
+	t.Helper()
+	got := make(map[string]int)
+	for range n {
+		status, body := fetch(t, hc, url)
+		if status != http.StatusOK {
+			t.Fatalf("got %d %q, want 200", status, body)
+		}
+		got[body]++
+	}
+	return got
+}
+
+func fetch(t *testing.T, hc *http.Client, url string) (status int, body string) {
+	t.Helper()
+	resp, err := hc.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
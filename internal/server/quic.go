@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// ServeQUIC accepts tunnels over QUIC on pc until Stop is called. Serve
+// runs it on QUICAddr; tests can hand it a socket of their own.
+func (s *Server) ServeQUIC(pc net.PacketConn) error {
+	tlsConf, err := s.quicTLSConfig()
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	l, err := quic.Listen(pc, tlsConf, tunnel.QUICConfig(s.cfg.StreamWindow))
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("quic listen: %w", err)
+	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		l.Close()
+		pc.Close()
+		return quic.ErrServerClosed
+	}
+	s.quicListener, s.quicConn = l, pc
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go s.handleQUIC(conn)
+	}
+}
+
+// handleQUIC registers a tunnel from a new QUIC connection, which opens with
+// its control stream.
+func (s *Server) handleQUIC(conn *quic.Conn) {
+	ctx, cancel := context.WithTimeout(conn.Context(), s.cfg.HandshakeTimeout)
+	qc, err := tunnel.AcceptQUIC(ctx, conn)
+	cancel()
+	if err != nil {
+		log.Printf("quic handshake error from %s: %v", conn.RemoteAddr(), err)
+		conn.CloseWithError(0, "")
+		return
+	}
+	s.handleNewTunnel(qc)
+}
+
+// quicTLSConfig loads QUICCertFile and QUICKeyFile, or makes a self-signed
+// certificate for Domain when they are unset.
+func (s *Server) quicTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if s.cfg.QUICCertFile != "" {
+		cert, err = tls.LoadX509KeyPair(s.cfg.QUICCertFile, s.cfg.QUICKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("quic certificate: %w", err)
+		}
+	} else {
+		cert, err = selfSignedCert(s.cfg.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("quic certificate: %w", err)
+		}
+		log.Printf("quic: no certificate given, using a self-signed one; clients must skip verification")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{tunnel.QUICProtocol},
+	}, nil
+}
+
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
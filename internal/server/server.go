@@ -1,19 +1,29 @@
 package server
 
 import (
-	"bufio"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/hashicorp/yamux"
+	"github.com/nitintf/openport/internal/metrics"
+	"github.com/nitintf/openport/internal/ratelimit"
 	"github.com/nitintf/openport/internal/tunnel"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // Config holds server configuration.
@@ -21,64 +31,398 @@ type Config struct {
 	Addr       string // public HTTP address
 	TunnelAddr string // address for client tunnel connections
 	Domain     string // base domain for subdomains
+	AdminAddr  string // address for the admin API and metrics (empty disables)
+
+	RateLimit    float64 // default requests per second per tunnel (0 = unlimited)
+	RateBurst    int     // default burst per tunnel
+	MaxRateLimit float64 // ceiling on client-requested tunnel rates (0 = RateLimit)
+	IPRateLimit  float64 // requests per second per source IP (0 = unlimited)
+	IPRateBurst  int     // burst per source IP
+
+	BandwidthLimit    int64 // default bytes per second per tunnel (0 = unlimited)
+	MaxBandwidthLimit int64 // ceiling on client-requested bandwidth (0 = BandwidthLimit)
+
+	AuthTokens         []string      // accepted client tokens (empty allows anyone)
+	HandshakeTimeout   time.Duration // deadline for a client to complete the handshake
+	MaxTunnelsPerIP    int           // concurrent tunnels per client IP (0 = unlimited)
+	MaxTunnelsPerToken int           // concurrent tunnels per auth token (0 = unlimited)
+	IdleTimeout        time.Duration // close tunnels with no traffic for this long (0 = never)
+	MaxTunnelLifetime  time.Duration // close tunnels older than this (0 = never)
+
+	ReadHeaderTimeout time.Duration // public side: time to read request headers
+	ReadTimeout       time.Duration // public side: time to read a whole request (0 = none)
+	WriteTimeout      time.Duration // public side: time to write a whole response (0 = none)
+	KeepAliveTimeout  time.Duration // public side: idle keep-alive connections
+	ResponseTimeout   time.Duration // time to wait for response headers from a tunnel (0 = none)
+	MaxRequestBody    int64         // largest request body forwarded, in bytes (0 = unlimited)
+	MaxResponseBody   int64         // largest response body returned, in bytes (0 = unlimited)
+
+	// TrustedProxies lists IPs or CIDRs of proxies in front of the server
+	// whose X-Forwarded-* and Forwarded headers are kept.
+	TrustedProxies []string
+
+	// CustomDomains lets clients bind their own hostnames, verified through
+	// a TXT record looked up with Resolver (nil uses the system resolver).
+	// The record values are derived from DomainKey, which must stay the
+	// same for them to keep matching; without one, a random key is used
+	// until the server restarts.
+	CustomDomains bool
+	Resolver      Resolver
+	DomainKey     string
+
+	// TLSAddr enables HTTPS for custom domains, with certificates issued on
+	// demand over ACME and cached in CertDir.
+	TLSAddr       string
+	CertDir       string
+	ACMEEmail     string
+	ACMEDirectory string // ACME directory URL (empty = Let's Encrypt)
+
+	// TLSPassthroughAddr accepts TLS connections for TLS tunnels, routed by
+	// SNI and relayed undecrypted (empty disables TLS tunnels).
+	TLSPassthroughAddr string
+
+	// UDPPortStart and UDPPortEnd bound the public ports handed to UDP
+	// tunnels (0 disables UDP tunnels). Peers idle for UDPIdleTimeout are
+	// forgotten.
+	UDPPortStart   int
+	UDPPortEnd     int
+	UDPIdleTimeout time.Duration
+
+	// StreamWindow is how many bytes of a response each tunnel stream may
+	// have in flight toward the server (0 = yamux's 256 KiB minimum, at
+	// most 16 MiB). Larger windows speed up big downloads over slow links
+	// at the cost of memory per stream.
+	StreamWindow uint32
+
+	// QUICAddr accepts tunnels over QUIC on this UDP address, usually the
+	// port of TunnelAddr (empty disables QUIC). The connection is secured
+	// with QUICCertFile and QUICKeyFile, or a self-signed certificate.
+	QUICAddr     string
+	QUICCertFile string
+	QUICKeyFile  string
+
+	// DisableCompression refuses clients that offer to compress bodies
+	// through the tunnel, e.g. when CPU matters more than bandwidth.
+	DisableCompression bool
 }
 
 // Server manages tunnel registrations and proxies HTTP traffic to connected clients.
 type Server struct {
-	cfg      Config
-	tunnels  map[string]*tunnel.Tunnel
-	mu       sync.RWMutex
-	listener net.Listener
-	httpSrv  *http.Server
+	cfg   Config
+	pools map[string]*pool // by subdomain
+	mu    sync.RWMutex
+	certs *autocert.Manager
+
+	// Listeners and servers opened by Serve, guarded by mu.
+	listener     net.Listener
+	passthrough  net.Listener
+	quicListener *quic.Listener
+	quicConn     net.PacketConn
+	httpSrv      *http.Server
+	tlsSrv       *http.Server
+	adminSrv     *http.Server
+	admin        net.Listener // from UseAdmin
+	stopped      bool         // set by Stop; Serve and ServeQUIC then give up
+
+	trustedProxies []netip.Prefix
+
+	ipLimiter   *ratelimit.Keyed
+	metrics     *metrics.Registry
+	requests    *metrics.CounterVec
+	limited     *metrics.CounterVec
+	connections *metrics.CounterVec
+
+	// retired accumulates the traffic of tunnels that have disconnected.
+	retired tunnel.Stats
+
+	// Admission bookkeeping, guarded by mu. reserved holds subdomains whose
+	// handshake is still in progress.
+	reserved      map[string]bool
+	tunnelsByIP   map[string]int
+	tunnelsByAuth map[string]int
+
+	// domains maps bound custom hostnames to their subdomain, guarded by mu.
+	domains   map[string]string
+	domainKey []byte // see Config.DomainKey
 }
 
 // New creates a new Server.
 func New(cfg Config) (*Server, error) {
+	trusted, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
-		cfg:     cfg,
-		tunnels: make(map[string]*tunnel.Tunnel),
+		cfg:       cfg,
+		pools:     make(map[string]*pool),
+		reserved:  make(map[string]bool),
+		ipLimiter: ratelimit.NewKeyed(cfg.IPRateLimit, cfg.IPRateBurst),
+		metrics:   metrics.NewRegistry(),
+
+		trustedProxies: trusted,
+
+		tunnelsByIP:   make(map[string]int),
+		tunnelsByAuth: make(map[string]int),
+		domains:       make(map[string]string),
+	}
+	if s.cfg.HandshakeTimeout <= 0 {
+		s.cfg.HandshakeTimeout = defaultHandshakeTimeout
 	}
+	if cfg.TLSAddr != "" {
+		s.certs = s.newCertManager()
+	}
+	if cfg.CustomDomains {
+		s.domainKey = domainKey(cfg.DomainKey)
+	}
+
+	s.requests = s.metrics.NewCounterVec("openport_http_requests_total",
+		"Public HTTP requests forwarded to tunnels.")
+	s.limited = s.metrics.NewCounterVec("openport_rate_limited_total",
+		"Public HTTP requests rejected by a rate limit.", "scope")
+	s.connections = s.metrics.NewCounterVec("openport_connections_total",
+		"Public connections relayed to non-HTTP tunnels.", "type")
+	s.metrics.NewGaugeFunc("openport_tunnels_active",
+		"Currently registered tunnels.", func() float64 {
+			return float64(len(s.allTunnels()))
+		})
+
+	s.metrics.NewCounterFunc("openport_bytes_total",
+		"Bytes proxied through all tunnels.", []string{"direction"},
+		func(emit func(float64, ...string)) {
+			in, out := s.retired.BytesIn.Load(), s.retired.BytesOut.Load()
+			for _, t := range s.allTunnels() {
+				in += t.Stats.BytesIn.Load()
+				out += t.Stats.BytesOut.Load()
+			}
+			emit(float64(in), "in")
+			emit(float64(out), "out")
+		})
+	s.metrics.NewCounterFunc("openport_tunnel_bytes_total",
+		"Bytes proxied per active tunnel.", []string{"subdomain", "tunnel", "direction"},
+		func(emit func(float64, ...string)) {
+			for _, t := range s.allTunnels() {
+				emit(float64(t.Stats.BytesIn.Load()), t.Subdomain, t.ID, "in")
+				emit(float64(t.Stats.BytesOut.Load()), t.Subdomain, t.ID, "out")
+			}
+		})
+
 	return s, nil
 }
 
 // Start begins listening for both tunnel client connections and public HTTP traffic.
 func (s *Server) Start() error {
-	var err error
-	s.listener, err = net.Listen("tcp", s.cfg.TunnelAddr)
+	tunnels, err := net.Listen("tcp", s.cfg.TunnelAddr)
 	if err != nil {
 		return fmt.Errorf("tunnel listen: %w", err)
 	}
+	public, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		tunnels.Close()
+		return fmt.Errorf("http listen: %w", err)
+	}
+	return s.Serve(tunnels, public)
+}
 
-	go s.acceptTunnels()
+// Serve is like Start but takes listeners for tunnel connections and public
+// HTTP traffic that the caller has already opened, for instance on
+// ephemeral ports in tests. The other listeners still come from Config. All
+// of them are opened before any is served, so if one can't be, Serve closes
+// the rest and returns the error at once.
+func (s *Server) Serve(tunnels, public net.Listener) error {
+	s.mu.Lock()
+	passthrough, adminLn := s.passthrough, s.admin
+	s.mu.Unlock()
+	if s.cfg.TLSPassthroughAddr == "" {
+		passthrough = nil
+	}
+	if s.cfg.AdminAddr == "" {
+		adminLn = nil
+	}
+	opened := []io.Closer{tunnels, public}
+	for _, l := range []net.Listener{passthrough, adminLn} {
+		if l != nil {
+			opened = append(opened, l)
+		}
+	}
+	fail := func(err error) error {
+		for _, c := range opened {
+			c.Close()
+		}
+		return err
+	}
+	listen := func(name, addr string) (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s listen: %w", name, err)
+		}
+		opened = append(opened, l)
+		return l, nil
+	}
+
+	if s.cfg.TLSPassthroughAddr != "" && passthrough == nil {
+		var err error
+		if passthrough, err = listen("tls passthrough", s.cfg.TLSPassthroughAddr); err != nil {
+			return fail(err)
+		}
+	}
+	var quicConn net.PacketConn
+	if s.cfg.QUICAddr != "" {
+		var err error
+		quicConn, err = net.ListenPacket("udp", s.cfg.QUICAddr)
+		if err != nil {
+			return fail(fmt.Errorf("quic listen: %w", err))
+		}
+		opened = append(opened, quicConn)
+	}
+	var tlsLn net.Listener
+	if s.cfg.AdminAddr != "" && adminLn == nil {
+		var err error
+		if adminLn, err = listen("admin", s.cfg.AdminAddr); err != nil {
+			return fail(err)
+		}
+	}
+	if s.certs != nil {
+		var err error
+		if tlsLn, err = listen("tls", s.cfg.TLSAddr); err != nil {
+			return fail(err)
+		}
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc(tunnel.ConnectPath, s.handleConnect)
 	mux.HandleFunc("/", s.handleHTTP)
+	httpSrv := s.publicServer(s.cfg.Addr, s.challengeHandler(mux))
+
+	var tlsSrv, adminSrv *http.Server
+	if tlsLn != nil {
+		tlsSrv = s.publicServer(s.cfg.TLSAddr, mux)
+		tlsSrv.TLSConfig = s.certs.TLSConfig()
+	}
+	if adminLn != nil {
+		admin := http.NewServeMux()
+		admin.Handle("/metrics", s.metrics)
+		admin.HandleFunc("/api/tunnels", s.handleListTunnels)
+		adminSrv = &http.Server{
+			Addr:    s.cfg.AdminAddr,
+			Handler: admin,
+		}
+	}
+
+	// Once registered, everything is closed by Stop; if Stop came first,
+	// nothing is served.
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return fail(http.ErrServerClosed)
+	}
+	s.listener, s.passthrough = tunnels, passthrough
+	s.httpSrv, s.tlsSrv, s.adminSrv = httpSrv, tlsSrv, adminSrv
+	s.mu.Unlock()
 
-	s.httpSrv = &http.Server{
-		Addr:    s.cfg.Addr,
-		Handler: mux,
+	go s.acceptTunnels()
+	if passthrough != nil {
+		go s.acceptPassthrough(passthrough)
+	}
+	if quicConn != nil {
+		go func() {
+			if err := s.ServeQUIC(quicConn); err != nil && !errors.Is(err, quic.ErrServerClosed) {
+				log.Printf("quic accept error: %v", err)
+			}
+		}()
+	}
+	if adminSrv != nil {
+		go func() {
+			if err := adminSrv.Serve(adminLn); err != nil && err != http.ErrServerClosed {
+				log.Printf("admin serve error: %v", err)
+			}
+		}()
+	}
+	if tlsSrv != nil {
+		go func() {
+			if err := tlsSrv.ServeTLS(tlsLn, "", ""); err != nil && err != http.ErrServerClosed {
+				log.Printf("tls serve error: %v", err)
+			}
+		}()
+	}
+	return httpSrv.Serve(public)
+}
+
+// UseAdmin makes Serve answer the admin API and metrics on l instead of
+// listening on AdminAddr itself, which must still be set.
+func (s *Server) UseAdmin(l net.Listener) {
+	s.mu.Lock()
+	s.admin = l
+	s.mu.Unlock()
+}
+
+// publicServer returns an http.Server for public traffic on addr. It speaks
+// HTTP/1.1, HTTP/2 over TLS and cleartext HTTP/2 (h2c) with prior knowledge.
+func (s *Server) publicServer(addr string, handler http.Handler) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Server{
+		Protocols:         protocols,
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.KeepAliveTimeout,
 	}
-	return s.httpSrv.ListenAndServe()
 }
 
 // Stop shuts down the server.
 func (s *Server) Stop() {
-	if s.listener != nil {
-		s.listener.Close()
+	s.mu.Lock()
+	s.stopped = true
+	listener, passthrough := s.listener, s.passthrough
+	quicListener, quicConn := s.quicListener, s.quicConn
+	httpSrv, tlsSrv, adminSrv := s.httpSrv, s.tlsSrv, s.adminSrv
+	s.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	if passthrough != nil {
+		passthrough.Close()
+	}
+	if quicListener != nil {
+		quicListener.Close()
+		quicConn.Close()
+	}
+	if httpSrv != nil {
+		httpSrv.Close()
 	}
-	if s.httpSrv != nil {
-		s.httpSrv.Close()
+	if tlsSrv != nil {
+		tlsSrv.Close()
+	}
+	if adminSrv != nil {
+		adminSrv.Close()
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for _, t := range s.tunnels {
+	for _, t := range s.allTunnels() {
 		t.Session.Close()
 		t.Conn.Close()
 	}
 }
 
+// allTunnels returns every registered tunnel across all pools.
+func (s *Server) allTunnels() []*tunnel.Tunnel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var all []*tunnel.Tunnel
+	for _, p := range s.pools {
+		all = append(all, p.members...)
+	}
+	return all
+}
+
 func (s *Server) acceptTunnels() {
 	for {
 		conn, err := s.listener.Accept()
@@ -91,6 +435,10 @@ func (s *Server) acceptTunnels() {
 }
 
 func (s *Server) handleNewTunnel(conn net.Conn) {
+	// A client that never finishes the handshake must not hold the
+	// goroutine forever.
+	conn.SetDeadline(time.Now().Add(s.cfg.HandshakeTimeout))
+
 	hs, err := tunnel.ReadHandshake(conn)
 	if err != nil {
 		log.Printf("handshake error: %v", err)
@@ -98,34 +446,105 @@ func (s *Server) handleNewTunnel(conn net.Conn) {
 		return
 	}
 
-	subdomain := hs.Subdomain
+	// Hostnames are case-insensitive, and public requests are matched
+	// against lowercase labels.
+	subdomain := strings.ToLower(hs.Subdomain)
 	if subdomain == "" {
 		subdomain = randomSubdomain()
 	}
 
-	s.mu.Lock()
-	if _, exists := s.tunnels[subdomain]; exists {
-		s.mu.Unlock()
-		tunnel.SendHandshakeResp(conn, tunnel.HandshakeResp{
-			Error: fmt.Sprintf("subdomain %q is already in use", subdomain),
-		})
+	ip := connIP(conn)
+	if rej := checkVersion(hs); rej != nil {
+		log.Printf("tunnel rejected from %s: %s", ip, rej.Error)
+		tunnel.SendHandshakeResp(conn, *rej)
 		conn.Close()
 		return
 	}
-	s.mu.Unlock()
+	if hs.DomainRecords {
+		tunnel.SendHandshakeResp(conn, s.domainRecords(hs))
+		conn.Close()
+		return
+	}
+	if rej := s.checkType(hs); rej != nil {
+		log.Printf("tunnel rejected from %s: %s", ip, rej.Error)
+		tunnel.SendHandshakeResp(conn, *rej)
+		conn.Close()
+		return
+	}
+	if rej := s.verifyDomains(&hs); rej != nil {
+		log.Printf("tunnel rejected from %s: %s", ip, rej.Error)
+		tunnel.SendHandshakeResp(conn, *rej)
+		conn.Close()
+		return
+	}
+	if rej := s.admit(subdomain, ip, hs); rej != nil {
+		log.Printf("tunnel rejected from %s: %s", ip, rej.Error)
+		tunnel.SendHandshakeResp(conn, *rej)
+		conn.Close()
+		return
+	}
+	defer s.release(ip, hs.Token)
 
 	url := fmt.Sprintf("http://%s.%s%s", subdomain, s.cfg.Domain, s.cfg.Addr)
+	var udpConn net.PacketConn
+	switch {
+	case hs.E2E:
+		url = s.e2eURL(subdomain + "." + s.cfg.Domain)
+	case hs.Type == tunnel.TypeTLS:
+		url = fmt.Sprintf("tls://%s.%s%s", subdomain, s.cfg.Domain, s.cfg.TLSPassthroughAddr)
+	case hs.Type == tunnel.TypeUDP:
+		udpConn, err = s.listenUDP()
+		if err != nil {
+			log.Printf("tunnel rejected from %s: %v", ip, err)
+			tunnel.SendHandshakeResp(conn, tunnel.HandshakeResp{
+				Code:  tunnel.CodePortsExhausted,
+				Error: err.Error(),
+			})
+			s.unreserve(subdomain)
+			conn.Close()
+			return
+		}
+		defer udpConn.Close()
+		url = fmt.Sprintf("udp://%s:%d", s.cfg.Domain, udpConn.LocalAddr().(*net.UDPAddr).Port)
+	}
 
-	tunnel.SendHandshakeResp(conn, tunnel.HandshakeResp{
-		Subdomain: subdomain,
-		URL:       url,
-	})
+	var domainURLs []string
+	for _, d := range hs.Domains {
+		if hs.E2E {
+			domainURLs = append(domainURLs, s.e2eURL(d))
+		} else {
+			domainURLs = append(domainURLs, s.domainURL(d))
+		}
+	}
+
+	compression := s.compression(hs)
+	resp := tunnel.HandshakeResp{
+		Version:     tunnel.ProtocolVersion,
+		Subdomain:   subdomain,
+		URL:         url,
+		Domains:     domainURLs,
+		Compression: compression,
+	}
+	if hs.E2E {
+		resp.ACMEDirectory = s.cfg.ACMEDirectory
+	}
+
+	// The tunnel is registered before the reply goes out, so it can be
+	// reached as soon as the client has its URL. Until then the session's
+	// writes are held back, so no stream overtakes the reply on conn.
+	held := &heldConn{Conn: conn, released: make(chan struct{})}
+	var sessionConn net.Conn = held
+	if _, ok := conn.(*tunnel.QUICConn); ok {
+		// Streams are separate from the handshake's.
+		sessionConn = conn
+	}
 
 	// Server is the yamux client (opens streams TO the tunnel client).
 	// The tunnel client is the yamux server (accepts streams).
-	session, err := yamux.Client(conn, nil)
+	session, err := tunnel.ServerSession(sessionConn, s.cfg.StreamWindow)
 	if err != nil {
-		log.Printf("yamux session error: %v", err)
+		log.Printf("session error: %v", err)
+		s.unreserve(subdomain)
 		conn.Close()
 		return
 	}
@@ -135,21 +554,255 @@ func (s *Server) handleNewTunnel(conn net.Conn) {
 		Subdomain: subdomain,
 		Conn:      conn,
 		Session:   session,
+		Limiter:   ratelimit.New(s.tunnelRate(hs)),
+		Bandwidth: ratelimit.New(s.tunnelBandwidth(hs)),
+		Created:   time.Now(),
+
+		Compression: compression,
 	}
 
 	s.mu.Lock()
-	s.tunnels[subdomain] = t
+	delete(s.reserved, subdomain)
+	p, ok := s.pools[subdomain]
+	if !ok {
+		p = newPool(subdomain, hs.Token, hs)
+		s.pools[subdomain] = p
+	} else if !p.joinable(hs, hs.Token) {
+		// Another client claimed the subdomain while this handshake was
+		// in flight.
+		s.mu.Unlock()
+		log.Printf("tunnel dropped: subdomain %s was taken during handshake", subdomain)
+		session.Close()
+		conn.Close()
+		return
+	}
+	if !s.bindDomains(subdomain, hs.Domains) {
+		if len(p.members) == 0 {
+			delete(s.pools, subdomain)
+		}
+		s.mu.Unlock()
+		log.Printf("tunnel dropped: a domain for %s was bound during handshake", subdomain)
+		session.Close()
+		conn.Close()
+		return
+	}
+	p.members = append(p.members, t)
+	members := len(p.members)
 	s.mu.Unlock()
 
-	log.Printf("tunnel registered: %s -> %s (%s)", subdomain, t.ID, url)
+	defer func() {
+		s.mu.Lock()
+		p.remove(t)
+		if len(p.members) == 0 && s.pools[subdomain] == p {
+			delete(s.pools, subdomain)
+			s.unbindDomains(subdomain)
+		}
+		s.retired.BytesIn.Add(t.Stats.BytesIn.Load())
+		s.retired.BytesOut.Add(t.Stats.BytesOut.Load())
+		s.mu.Unlock()
+		log.Printf("tunnel unregistered: %s (in %d bytes, out %d bytes)", subdomain, t.Stats.BytesIn.Load(), t.Stats.BytesOut.Load())
+	}()
+
+	err = tunnel.SendHandshakeResp(conn, resp)
+	conn.SetDeadline(time.Time{})
+	held.release()
+	if err != nil {
+		log.Printf("handshake error: %v", err)
+		session.Close()
+		return
+	}
+
+	if p.shared {
+		log.Printf("pool %s: %d member(s), %s", subdomain, members, p.balance)
+	}
+
+	if t.Limiter != nil {
+		log.Printf("tunnel registered: %s -> %s (%s, %.4g req/s burst %d)", subdomain, t.ID, url, t.Limiter.Rate(), t.Limiter.Burst())
+	} else {
+		log.Printf("tunnel registered: %s -> %s (%s)", subdomain, t.ID, url)
+	}
+	if len(hs.Domains) > 0 {
+		log.Printf("domains bound to %s: %s", subdomain, strings.Join(hs.Domains, ", "))
+	}
+
+	stopExpiry := s.watchExpiry(t)
+	defer stopExpiry()
+
+	if udpConn != nil {
+		go s.serveUDP(t, udpConn)
+	}
 
 	// Block until the session is closed (client disconnected).
 	<-session.CloseChan()
+}
 
-	s.mu.Lock()
-	delete(s.tunnels, subdomain)
-	s.mu.Unlock()
-	log.Printf("tunnel unregistered: %s", subdomain)
+// heldConn holds back writes until release is called or the conn closed.
+type heldConn struct {
+	net.Conn
+	released chan struct{}
+	once     sync.Once
+}
+
+func (c *heldConn) Write(b []byte) (int, error) {
+	<-c.released
+	return c.Conn.Write(b)
+}
+
+func (c *heldConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *heldConn) release() {
+	c.once.Do(func() { close(c.released) })
+}
+
+// checkVersion rejects clients speaking another version of the protocol,
+// which would otherwise fail on their first stream with errors that say
+// nothing of the cause.
+func checkVersion(hs tunnel.Handshake) *tunnel.HandshakeResp {
+	if hs.Version == tunnel.ProtocolVersion {
+		return nil
+	}
+	return &tunnel.HandshakeResp{
+		Code:  tunnel.CodeUnsupported,
+		Error: fmt.Sprintf("client speaks protocol version %d, but this server speaks %d; use a matching release of op", hs.Version, tunnel.ProtocolVersion),
+	}
+}
+
+// checkType rejects tunnel types the server does not offer.
+func (s *Server) checkType(hs tunnel.Handshake) *tunnel.HandshakeResp {
+	if hs.E2E && tunnelType(hs) != tunnel.TypeTLS {
+		return &tunnel.HandshakeResp{
+			Code:  tunnel.CodeUnsupported,
+			Error: "end-to-end encryption needs a tls tunnel",
+		}
+	}
+	switch tunnelType(hs) {
+	case tunnel.TypeHTTP:
+		return nil
+	case tunnel.TypeTLS:
+		if s.cfg.TLSPassthroughAddr != "" {
+			return nil
+		}
+		if hs.E2E {
+			return &tunnel.HandshakeResp{
+				Code:  tunnel.CodeUnsupported,
+				Error: "end-to-end encrypted tunnels need TLS passthrough, which is not enabled on this server",
+			}
+		}
+	case tunnel.TypeUDP:
+		if hs.Pool {
+			return &tunnel.HandshakeResp{
+				Code:  tunnel.CodeUnsupported,
+				Error: "udp tunnels cannot be shared in a pool",
+			}
+		}
+		if s.cfg.UDPPortEnd > 0 {
+			return nil
+		}
+	}
+	return &tunnel.HandshakeResp{
+		Code:  tunnel.CodeUnsupported,
+		Error: fmt.Sprintf("%s tunnels are not enabled on this server", tunnelType(hs)),
+	}
+}
+
+// compression picks the payload compression for a new tunnel from those the
+// client offered. Only HTTP tunnels carry bodies the server understands.
+func (s *Server) compression(hs tunnel.Handshake) string {
+	if s.cfg.DisableCompression || tunnelType(hs) != tunnel.TypeHTTP {
+		return ""
+	}
+	if slices.Contains(hs.Compression, tunnel.CompressionGzip) {
+		return tunnel.CompressionGzip
+	}
+	return ""
+}
+
+// tunnelRate resolves the request rate for a new tunnel. Clients may ask for
+// their own limit, but never above the operator's ceiling.
+func (s *Server) tunnelRate(hs tunnel.Handshake) (float64, int) {
+	rate, burst := s.cfg.RateLimit, s.cfg.RateBurst
+
+	ceiling := s.cfg.MaxRateLimit
+	if ceiling <= 0 {
+		ceiling = s.cfg.RateLimit
+	}
+	if hs.RateLimit > 0 {
+		rate = hs.RateLimit
+		if ceiling > 0 && rate > ceiling {
+			rate = ceiling
+		}
+	}
+	if hs.RateBurst > 0 && (burst <= 0 || hs.RateBurst < burst) {
+		burst = hs.RateBurst
+	}
+	return rate, burst
+}
+
+// tunnelBandwidth resolves the byte rate for a new tunnel, following the same
+// default and ceiling rules as tunnelRate. The burst is one second of traffic.
+func (s *Server) tunnelBandwidth(hs tunnel.Handshake) (float64, int) {
+	limit := s.cfg.BandwidthLimit
+
+	ceiling := s.cfg.MaxBandwidthLimit
+	if ceiling <= 0 {
+		ceiling = s.cfg.BandwidthLimit
+	}
+	if hs.BandwidthLimit > 0 {
+		limit = hs.BandwidthLimit
+		if ceiling > 0 && limit > ceiling {
+			limit = ceiling
+		}
+	}
+	return float64(limit), int(limit)
+}
+
+// TunnelInfo describes an active tunnel in the admin API.
+type TunnelInfo struct {
+	ID             string    `json:"id"`
+	Subdomain      string    `json:"subdomain"`
+	Type           string    `json:"type"`
+	E2E            bool      `json:"e2e,omitempty"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Shared         bool      `json:"shared,omitempty"`
+	Created        time.Time `json:"created"`
+	BytesIn        uint64    `json:"bytes_in"`
+	BytesOut       uint64    `json:"bytes_out"`
+	RateLimit      float64   `json:"rate_limit,omitempty"`
+	BandwidthLimit float64   `json:"bandwidth_limit,omitempty"`
+}
+
+func (s *Server) handleListTunnels(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	var infos []TunnelInfo
+	for _, p := range s.pools {
+		for _, t := range p.members {
+			infos = append(infos, TunnelInfo{
+				ID:             t.ID,
+				Subdomain:      t.Subdomain,
+				Type:           p.kind,
+				E2E:            p.e2e,
+				RemoteAddr:     t.Conn.RemoteAddr().String(),
+				Shared:         p.shared,
+				Created:        t.Created,
+				BytesIn:        t.Stats.BytesIn.Load(),
+				BytesOut:       t.Stats.BytesOut.Load(),
+				RateLimit:      t.Limiter.Rate(),
+				BandwidthLimit: t.Bandwidth.Rate(),
+			})
+		}
+	}
+	s.mu.RUnlock()
+	if infos == nil {
+		infos = []TunnelInfo{}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -158,43 +811,216 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
-	subdomain := extractSubdomain(r.Host, s.cfg.Domain)
+	subdomain := s.lookupSubdomain(r.Host)
 	if subdomain == "" {
 		http.Error(w, "openport: no tunnel specified", http.StatusBadRequest)
 		return
 	}
 
+	if ok, wait := s.ipLimiter.Allow(s.clientIP(r)); !ok {
+		s.limited.With("ip").Inc()
+		tooManyRequests(w, wait)
+		return
+	}
+
 	s.mu.RLock()
-	t, ok := s.tunnels[subdomain]
+	p, ok := s.pools[subdomain]
+	var t *tunnel.Tunnel
+	if ok {
+		t = p.pick(r, nil)
+	}
 	s.mu.RUnlock()
 
-	if !ok {
+	if t == nil {
 		http.Error(w, fmt.Sprintf("openport: tunnel %q not found", subdomain), http.StatusNotFound)
 		return
 	}
-
-	// Open a new yamux stream to the client for this request.
-	stream, err := t.Session.Open()
-	if err != nil {
-		http.Error(w, "openport: failed to reach tunnel client", http.StatusBadGateway)
-		log.Printf("yamux open stream error for %s: %v", subdomain, err)
+	switch {
+	case p.kind == tunnel.TypeHTTP:
+	case p.e2e && strings.HasPrefix(r.URL.Path, tunnel.ACMEChallengePath):
+		// The client proves it controls the host to get its certificate.
+	case p.e2e:
+		redirectE2E(w, r, s.e2eURL(hostname(r.Host)))
 		return
+	default:
+		http.Error(w, fmt.Sprintf("openport: tunnel %q does not serve HTTP", subdomain), http.StatusMisdirectedRequest)
+		return
+	}
+
+	// Open a new stream to the client for this request, once the member's
+	// rate limit allows it. Pool members over their limit are passed over
+	// for this request, and those that can't open a stream are dropped;
+	// either way the next one is tried. A member shutting down refuses new
+	// streams but keeps its session until the requests it is still serving
+	// finish.
+	var raw net.Conn
+	var failed []*tunnel.Tunnel
+	var limited bool
+	var retry time.Duration // the shortest wait among members over their limit
+	for {
+		if ok, wait := t.Limiter.Allow(); !ok {
+			if !limited || wait < retry {
+				limited, retry = true, wait
+			}
+		} else {
+			var err error
+			if raw, err = t.Session.Open(); err == nil {
+				break
+			}
+			log.Printf("open stream error for %s (%s): %v", subdomain, t.ID, err)
+			if !errors.Is(err, tunnel.ErrGoAway) {
+				t.Session.Close()
+			}
+		}
+		failed = append(failed, t)
+
+		s.mu.RLock()
+		t = p.pick(r, failed)
+		s.mu.RUnlock()
+		if t == nil && limited {
+			s.limited.With("tunnel").Inc()
+			tooManyRequests(w, retry)
+			return
+		}
+		if t == nil {
+			http.Error(w, "openport: failed to reach tunnel client", http.StatusBadGateway)
+			return
+		}
 	}
-	defer stream.Close()
+	defer raw.Close()
+	s.requests.With().Inc()
+
+	t.InFlight.Add(1)
+	t.Touch()
+	defer func(t *tunnel.Tunnel) {
+		t.Touch()
+		t.InFlight.Add(-1)
+	}(t)
 
-	// Write the incoming HTTP request into the stream.
-	if err := r.Write(stream); err != nil {
+	p.setSticky(w, t)
+	stream := tunnel.Meter(raw, &t.Stats.BytesOut, &t.Stats.BytesIn, t.Bandwidth)
+
+	if err := tunnel.WriteStreamKind(stream, tunnel.StreamHTTP); err != nil {
 		http.Error(w, "openport: failed to forward request", http.StatusBadGateway)
 		return
 	}
 
+	var reqBody *limitedBody
+	if max := s.cfg.MaxRequestBody; max > 0 {
+		if r.ContentLength > max {
+			requestTooLarge(w)
+			return
+		}
+		reqBody = &limitedBody{ReadCloser: r.Body, remaining: max}
+		r.Body = reqBody
+	}
+
+	s.setForwardedHeaders(r)
+	// Only the ends of the tunnel may mark a body compressed. From a
+	// visitor, the marks would have the client inflate a small body
+	// past MaxRequestBody.
+	r.Header.Del(tunnel.EncodingHeader)
+	r.Header.Del(tunnel.LengthHeader)
+
+	// Write the request in the background so both bodies can stream at
+	// once, as gRPC needs. HTTP/1 handlers must opt in to reading the body
+	// after the response has started.
+	http.NewResponseController(w).EnableFullDuplex()
+	written := make(chan struct{})
+	var writeErr error
+	go func() {
+		// Request.Write holds the headers back until the first body chunk
+		// unless the buffer is flushed whenever the body would block.
+		mw := tunnel.NewMessageWriter(stream)
+		defer mw.Release()
+		if r.Body != nil && r.Body != http.NoBody {
+			if t.Compression != "" && tunnel.Compressible(r.Header, r.ContentLength) {
+				r.Body, r.ContentLength = tunnel.CompressBody(r.Header, r.Body, r.ContentLength, nil)
+			}
+			r.Body = mw.Body(r.Body)
+		}
+		if writeErr = r.Write(mw); writeErr == nil {
+			writeErr = mw.Flush()
+		}
+		close(written)
+		if writeErr != nil {
+			// Let the client see the request end.
+			stream.Close()
+		}
+	}()
+	defer func() {
+		// The request body must not be read once the handler returns.
+		raw.Close()
+		<-written
+	}()
+	tooLarge := func() bool {
+		select {
+		case <-written:
+			return reqBody != nil && reqBody.exceeded
+		default:
+			return false
+		}
+	}
+
 	// Read the HTTP response back from the stream.
-	resp, err := http.ReadResponse(bufio.NewReader(stream), r)
+	if s.cfg.ResponseTimeout > 0 {
+		stream.SetReadDeadline(time.Now().Add(s.cfg.ResponseTimeout))
+	}
+	br := tunnel.NewReader(stream)
+	pooled := true
+	defer func() {
+		if pooled {
+			tunnel.PutReader(br)
+		}
+	}()
+	resp, err := http.ReadResponse(br, r)
+	if tooLarge() {
+		requestTooLarge(w)
+		return
+	}
 	if err != nil {
+		if isTimeout(err) {
+			gatewayTimeout(w)
+			return
+		}
 		http.Error(w, "openport: failed to read response from tunnel", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
+	// Closing the body reads the rest of it, which a stream the visitor
+	// dropped, or one cut off at MaxResponseBody, may never end. Those
+	// close the tunnel stream instead, which tells the client to stop.
+	complete := false
+	defer func() {
+		if !complete {
+			raw.Close()
+			return
+		}
+		resp.Body.Close()
+	}()
+	stream.SetReadDeadline(time.Time{})
+
+	if t.Compression != "" {
+		if body, length, ok := tunnel.DecompressBody(resp.Header, resp.Body); ok {
+			resp.Body, resp.ContentLength = body, length
+		}
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// Relay returns once either direction ends, while the other may
+		// still be reading br, so it cannot go back to the pool.
+		pooled = false
+		upgrade(w, resp, struct {
+			io.Reader
+			io.WriteCloser
+		}{br, stream})
+		return
+	}
+
+	max := s.cfg.MaxResponseBody
+	if max > 0 && resp.ContentLength > max {
+		http.Error(w, "openport: response from local service is too large", http.StatusBadGateway)
+		return
+	}
 
 	// Copy response headers.
 	for k, vv := range resp.Header {
@@ -203,17 +1029,158 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+
+	var body io.Reader = resp.Body
+	if max > 0 {
+		body = io.LimitReader(resp.Body, max+1)
+	}
+	n, err := copyResponse(w, body, resp.ContentLength < 0)
+	if max > 0 && n > max {
+		// The status line is already out, so the only honest signal left
+		// is to cut the connection instead of ending the body cleanly.
+		log.Printf("response for %s exceeded %d bytes, aborting", subdomain, max)
+		panic(http.ErrAbortHandler)
+	}
+	complete = err == nil
+
+	// Trailers arrive after the body, e.g. grpc-status.
+	for k, vv := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+k] = vv
+	}
 }
 
+// upgrade completes a protocol switch such as a WebSocket handshake, then
+// relays raw bytes between the visitor and the tunnel until either side
+// closes.
+func upgrade(w http.ResponseWriter, resp *http.Response, stream io.ReadWriteCloser) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be taken over.
+		http.Error(w, "openport: protocol upgrade not supported on this connection", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	for k, vv := range w.Header() {
+		resp.Header[k] = append(resp.Header[k], vv...)
+	}
+	if err := resp.Write(buf); err != nil {
+		return
+	}
+	if err := buf.Flush(); err != nil {
+		return
+	}
+	tunnel.Relay(struct {
+		io.Reader
+		io.WriteCloser
+	}{buf.Reader, conn}, stream)
+}
+
+// copyResponse copies a response body to w. Streamed bodies of unknown
+// length are flushed as they arrive so server-sent events and gRPC streams
+// are not held in buffers.
+func copyResponse(w http.ResponseWriter, body io.Reader, stream bool) (int64, error) {
+	if !stream {
+		return tunnel.Copy(w, body)
+	}
+
+	// Send the headers now; a bidirectional stream may not produce a body
+	// until the visitor sends more.
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	return tunnel.Copy(flushWriter{w: w, rc: rc}, body)
+}
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		f.rc.Flush()
+	}
+	return n, err
+}
+
+// limitedBody fails once more than remaining bytes have been read, so an
+// oversized chunked upload is stopped partway through instead of forwarded.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.exceeded = true
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+var errBodyTooLarge = errors.New("body too large")
+
+func requestTooLarge(w http.ResponseWriter) {
+	http.Error(w, "openport: request body too large", http.StatusRequestEntityTooLarge)
+}
+
+// gatewayTimeout is sent when the local service, or the tunnel client in
+// front of it, takes too long to start responding.
+func gatewayTimeout(w http.ResponseWriter) {
+	http.Error(w, "openport: local service timed out", http.StatusGatewayTimeout)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "openport: rate limit exceeded", http.StatusTooManyRequests)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// extractSubdomain returns the label in front of baseDomain in a Host
+// header, e.g. "myapp" for "MyApp.example.com:8080". Hosts that are not
+// exactly one label under baseDomain yield "".
 func extractSubdomain(host, baseDomain string) string {
-	if idx := strings.LastIndex(host, ":"); idx != -1 {
-		host = host[:idx]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	suffix := "." + strings.TrimSuffix(strings.ToLower(baseDomain), ".")
+	if !strings.HasSuffix(host, suffix) {
+		return ""
 	}
-	if !strings.HasSuffix(host, "."+baseDomain) {
+	sub := strings.TrimSuffix(host, suffix)
+	if strings.ContainsAny(sub, ".:[]") {
 		return ""
 	}
-	return strings.TrimSuffix(host, "."+baseDomain)
+	return sub
 }
 
 func randomSubdomain() string {
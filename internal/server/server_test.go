@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+func TestExtractSubdomain(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"myapp.example.com", "myapp"},
+		{"myapp.example.com:8080", "myapp"},
+		{"MyApp.Example.COM", "myapp"},
+		{"myapp.example.com.", "myapp"},
+		{"example.com", ""},
+		{".example.com", ""},
+		{"a.b.example.com", ""},
+		{"myapp.example.com.evil.net", ""},
+		{"notexample.com", ""},
+		{"[::1]:8080", ""},
+		{":8080", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := extractSubdomain(tt.host, "example.com"); got != tt.want {
+			t.Errorf("extractSubdomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	for wait, want := range map[time.Duration]string{
+		0:                       "1",
+		300 * time.Millisecond:  "1",
+		time.Second:             "1",
+		1500 * time.Millisecond: "2",
+		time.Minute:             "60",
+	} {
+		w := httptest.NewRecorder()
+		tooManyRequests(w, wait)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != want {
+			t.Errorf("wait %s: got %d with Retry-After %q, want 429 with %q", wait, w.Code, w.Header().Get("Retry-After"), want)
+		}
+	}
+}
+
+// TestRateLimitMetric checks that refused requests are counted by scope and
+// show up in the metrics output.
+func TestRateLimitMetric(t *testing.T) {
+	s, err := New(Config{Domain: "example.com", IPRateLimit: 1, IPRateBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		r := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		s.handleHTTP(httptest.NewRecorder(), r)
+	}
+	if n := s.limited.With("ip").Value(); n != 2 {
+		t.Fatalf("ip scope counted %d, want 2", n)
+	}
+
+	w := httptest.NewRecorder()
+	s.metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if want := `openport_rate_limited_total{scope="ip"} 2`; !strings.Contains(w.Body.String(), want) {
+		t.Fatalf("metrics output lacks %s:\n%s", want, w.Body)
+	}
+}
+
+// TestPoolFailover checks that a request the first member can't take goes to
+// the next, whether that member is gone or shutting down.
+func TestPoolFailover(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err     error
+		dropped bool
+	}{
+		"closed":        {err: io.ErrClosedPipe, dropped: true},
+		"shutting down": {err: tunnel.ErrGoAway},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New(Config{Domain: "example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gone := &tunnel.Tunnel{ID: "gone", Session: newFakeSession(nil, tc.err)}
+			live := &tunnel.Tunnel{ID: "live", Session: newFakeSession(func(c net.Conn) {
+				br := bufio.NewReader(c)
+				br.ReadByte() // the stream kind
+				if _, err := http.ReadRequest(br); err == nil {
+					io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nlive")
+				}
+			}, nil)}
+			p := newPool("app", "secret", tunnel.Handshake{Pool: true})
+			p.members = []*tunnel.Tunnel{gone, live}
+			s.pools["app"] = p
+
+			// Round robin would hand every other request to gone.
+			for range 2 {
+				w := httptest.NewRecorder()
+				s.handleHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+				if w.Code != http.StatusOK || w.Body.String() != "live" {
+					t.Fatalf("got %d %q, want 200 from live", w.Code, w.Body)
+				}
+			}
+			if gone.Session.IsClosed() != tc.dropped {
+				t.Fatalf("gone closed: %v, want %v", gone.Session.IsClosed(), tc.dropped)
+			}
+		})
+	}
+}
+
+// TestPassthroughFailover is TestPoolFailover for TLS tunnels.
+func TestPassthroughFailover(t *testing.T) {
+	cert, err := selfSignedCert("secure.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		err     error
+		dropped bool
+	}{
+		"closed":        {err: io.ErrClosedPipe, dropped: true},
+		"shutting down": {err: tunnel.ErrGoAway},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New(Config{Domain: "example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gone := &tunnel.Tunnel{ID: "gone", Session: newFakeSession(nil, tc.err)}
+			live := &tunnel.Tunnel{ID: "live", Session: newFakeSession(func(c net.Conn) {
+				var kind [1]byte
+				if _, err := io.ReadFull(c, kind[:]); err != nil || tunnel.StreamKind(kind[0]) != tunnel.StreamTLS {
+					return
+				}
+				tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+			}, nil)}
+			p := newPool("secure", "secret", tunnel.Handshake{Type: tunnel.TypeTLS, Pool: true})
+			p.members = []*tunnel.Tunnel{gone, live}
+			s.pools["secure"] = p
+
+			for range 2 {
+				visitor, conn := net.Pipe()
+				go s.handlePassthrough(conn)
+				tlsConn := tls.Client(visitor, &tls.Config{ServerName: "secure.example.com", InsecureSkipVerify: true})
+				tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+				if err := tlsConn.Handshake(); err != nil {
+					t.Fatalf("handshake: %v", err)
+				}
+				tlsConn.Close()
+			}
+			if gone.Session.IsClosed() != tc.dropped {
+				t.Fatalf("gone closed: %v, want %v", gone.Session.IsClosed(), tc.dropped)
+			}
+		})
+	}
+}
+
+// fakeSession stands in for a client's session. Open fails with err if it
+// is set, and otherwise hands the other end of the stream to serve.
+type fakeSession struct {
+	serve  func(net.Conn)
+	err    error
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeSession(serve func(net.Conn), err error) *fakeSession {
+	return &fakeSession{serve: serve, err: err, closed: make(chan struct{})}
+}
+
+func (f *fakeSession) Open() (net.Conn, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		f.serve(c2)
+	}()
+	return c1, nil
+}
+
+func (f *fakeSession) Accept() (net.Conn, error) {
+	<-f.closed
+	return nil, net.ErrClosed
+}
+
+func (f *fakeSession) GoAway() error { return nil }
+
+func (f *fakeSession) Close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeSession) CloseChan() <-chan struct{} { return f.closed }
+
+func (f *fakeSession) IsClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// TestServeCleanup checks that Serve leaves nothing running when a listener
+// from Config can't be opened, or when Stop came first.
+func TestServeCleanup(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	for name, tc := range map[string]struct {
+		cfg     Config
+		stopped bool
+	}{
+		"quic port in use":        {cfg: Config{QUICAddr: udp.LocalAddr().String()}},
+		"admin port in use":       {cfg: Config{AdminAddr: tcp.Addr().String()}},
+		"passthrough port in use": {cfg: Config{TLSPassthroughAddr: tcp.Addr().String()}},
+		"tls port in use":         {cfg: Config{TLSAddr: tcp.Addr().String(), AdminAddr: "127.0.0.1:0"}},
+		"stopped":                 {cfg: Config{AdminAddr: "127.0.0.1:0"}, stopped: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc.cfg.Domain = "example.com"
+			s, err := New(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.stopped {
+				s.Stop()
+			}
+			tunnels, _ := net.Listen("tcp", "127.0.0.1:0")
+			public, _ := net.Listen("tcp", "127.0.0.1:0")
+			if err := s.Serve(tunnels, public); err == nil {
+				t.Fatal("Serve succeeded")
+			}
+			for name, l := range map[string]net.Listener{"tunnel": tunnels, "public": public} {
+				if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+					t.Errorf("%s listener: got %v, want it closed", name, err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzExtractSubdomain(f *testing.F) {
+	f.Add("myapp.example.com:8080", "example.com")
+	f.Add("[::1]:80", "::1")
+	f.Add("a.b.localhost", "localhost")
+	f.Add(":", "")
+	f.Add("x..", ".")
+
+	f.Fuzz(func(t *testing.T, host, base string) {
+		sub := extractSubdomain(host, base)
+		if sub == "" {
+			return
+		}
+		if strings.ContainsAny(sub, ".:[]") || sub != strings.ToLower(sub) {
+			t.Fatalf("extractSubdomain(%q, %q) = %q, not a lowercase label", host, base, sub)
+		}
+		// Routing the subdomain back under base must give the same answer.
+		if again := extractSubdomain(sub+"."+base, base); again != sub {
+			t.Fatalf("extractSubdomain(%q, %q) = %q, but %q.%s gives %q", host, base, sub, sub, base, again)
+		}
+	})
+}
+
+// FuzzRequestOverStream writes a request the way handleHTTP forwards it and
+// checks that the client side of the stream reads back the same request.
+func FuzzRequestOverStream(f *testing.F) {
+	f.Add("GET", "/", "", "", false)
+	f.Add("POST", "/api/users?x=1", "X-Test", `{"a":1}`, true)
+	f.Add("PUT", "/%2Fescaped/path", "Content-Type", "\r\n\r\n", false)
+
+	f.Fuzz(func(t *testing.T, method, target, header, body string, chunked bool) {
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+			if chunked {
+				// Hide the length so the body is sent chunked.
+				r = io.MultiReader(r)
+			}
+		}
+		req, err := http.NewRequest(method, "http://app.example.com"+target, r)
+		if err != nil {
+			return
+		}
+		if header != "" {
+			req.Header.Set(header, "v")
+		}
+
+		var stream bytes.Buffer
+		mw := tunnel.NewMessageWriter(&stream)
+		defer mw.Release()
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = mw.Body(req.Body)
+		}
+		if err := req.Write(mw); err != nil {
+			return
+		}
+		if err := mw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		stream.WriteString("next")
+
+		br := bufio.NewReader(&stream)
+		got, err := http.ReadRequest(br)
+		if err != nil {
+			// Request.Write does not validate every field; anything it
+			// lets through that cannot be parsed is rejected cleanly.
+			return
+		}
+		gotBody, err := io.ReadAll(got.Body)
+		if err != nil {
+			t.Fatalf("reading body: %v", err)
+		}
+		if got.Method != req.Method || string(gotBody) != body {
+			t.Fatalf("got %s with body %q, want %s with body %q", got.Method, gotBody, req.Method, body)
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "next" {
+			t.Fatalf("request overran its framing, left %q", rest)
+		}
+	})
+}
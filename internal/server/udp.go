@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+const (
+	defaultUDPIdleTimeout = time.Minute
+
+	// maxUDPPeers caps the remote addresses a UDP tunnel relays at once.
+	// Datagrams from further peers are dropped until others expire.
+	maxUDPPeers = 1024
+)
+
+// listenUDP binds the first free port in the configured range.
+func (s *Server) listenUDP() (net.PacketConn, error) {
+	for port := s.cfg.UDPPortStart; port <= s.cfg.UDPPortEnd; port++ {
+		pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			return pc, nil
+		}
+	}
+	return nil, fmt.Errorf("no free UDP port in %d-%d", s.cfg.UDPPortStart, s.cfg.UDPPortEnd)
+}
+
+// udpQueueLen is how many datagrams from one peer may wait for its stream.
+// Further ones are dropped, as a congested network would.
+const udpQueueLen = 64
+
+// udpPeers tracks the remote addresses of one UDP tunnel.
+type udpPeers struct {
+	mu sync.Mutex
+	m  map[string]*udpPeer
+}
+
+// udpPeer is one remote address relayed over its own stream. Its datagrams
+// queue for the stream, so a slow peer holds up no one but itself.
+type udpPeer struct {
+	key      string
+	addr     net.Addr
+	queue    chan []byte
+	stream   net.Conn // set once opened, guarded by udpPeers.mu
+	lastSeen time.Time
+}
+
+// remove stops relaying for p, unless that was done already. The caller
+// must hold mu.
+func (ps *udpPeers) remove(p *udpPeer) {
+	if ps.m[p.key] != p {
+		return
+	}
+	delete(ps.m, p.key)
+	close(p.queue)
+	if p.stream != nil {
+		p.stream.Close()
+	}
+}
+
+// serveUDP relays datagrams between pc and t until pc is closed. Each remote
+// address gets its own stream, so the client can answer from a matching
+// local socket; streams idle for UDPIdleTimeout are closed.
+func (s *Server) serveUDP(t *tunnel.Tunnel, pc net.PacketConn) {
+	peers := &udpPeers{m: make(map[string]*udpPeer)}
+
+	idle := s.cfg.UDPIdleTimeout
+	if idle <= 0 {
+		idle = defaultUDPIdleTimeout
+	}
+	stopSweep := make(chan struct{})
+	defer close(stopSweep)
+	go func() {
+		ticker := time.NewTicker(idle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stopSweep:
+				return
+			}
+			peers.mu.Lock()
+			for _, p := range peers.m {
+				if time.Since(p.lastSeen) >= idle {
+					peers.remove(p)
+				}
+			}
+			peers.mu.Unlock()
+		}
+	}()
+
+	defer func() {
+		peers.mu.Lock()
+		for _, p := range peers.m {
+			peers.remove(p)
+		}
+		peers.mu.Unlock()
+	}()
+
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("udp read error for %s: %v", t.Subdomain, err)
+			}
+			return
+		}
+		t.Touch()
+
+		key := addr.String()
+		peers.mu.Lock()
+		p, ok := peers.m[key]
+		if !ok && s.admitUDPPeer(t, addr, len(peers.m)) {
+			p = &udpPeer{key: key, addr: addr, queue: make(chan []byte, udpQueueLen)}
+			peers.m[key] = p
+			go s.relayUDPPeer(t, pc, peers, p)
+		}
+		if p != nil {
+			p.lastSeen = time.Now()
+			select {
+			case p.queue <- bytes.Clone(buf[:n]):
+			default:
+				// The peer's stream is backed up.
+			}
+		}
+		peers.mu.Unlock()
+	}
+}
+
+// admitUDPPeer reports whether a new remote address may be relayed, given
+// the number already active.
+func (s *Server) admitUDPPeer(t *tunnel.Tunnel, addr net.Addr, active int) bool {
+	if active >= maxUDPPeers {
+		return false
+	}
+	if ok, _ := s.ipLimiter.Allow(udpIP(addr)); !ok {
+		s.limited.With("ip").Inc()
+		return false
+	}
+	if ok, _ := t.Limiter.Allow(); !ok {
+		s.limited.With("tunnel").Inc()
+		return false
+	}
+	return true
+}
+
+// relayUDPPeer opens the stream for a new remote address, sends it the
+// datagrams queued for p and relays the replies, until p is removed or the
+// stream fails.
+func (s *Server) relayUDPPeer(t *tunnel.Tunnel, pc net.PacketConn, peers *udpPeers, p *udpPeer) {
+	t.InFlight.Add(1)
+	defer t.InFlight.Add(-1)
+	defer func() {
+		peers.mu.Lock()
+		peers.remove(p)
+		peers.mu.Unlock()
+	}()
+
+	raw, err := t.Session.Open()
+	if err != nil {
+		log.Printf("open stream error for %s (%s): %v", t.Subdomain, t.ID, err)
+		return
+	}
+	peers.mu.Lock()
+	if peers.m[p.key] != p {
+		// Removed while the stream was opening.
+		peers.mu.Unlock()
+		raw.Close()
+		return
+	}
+	p.stream = raw
+	peers.mu.Unlock()
+
+	stream := tunnel.Meter(raw, &t.Stats.BytesOut, &t.Stats.BytesIn, t.Bandwidth)
+	if tunnel.WriteStreamKind(stream, tunnel.StreamUDP) != nil ||
+		tunnel.WriteDatagram(stream, []byte(p.key)) != nil {
+		return
+	}
+	s.connections.With(tunnel.TypeUDP).Inc()
+
+	go func() {
+		buf := make([]byte, tunnel.MaxDatagramSize)
+		for {
+			reply, err := tunnel.ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			t.Touch()
+			if _, err := pc.WriteTo(reply, p.addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	for datagram := range p.queue {
+		if err := tunnel.WriteDatagram(stream, datagram); err != nil {
+			return
+		}
+	}
+}
+
+func udpIP(addr net.Addr) string {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u.IP.String()
+	}
+	return addr.String()
+}
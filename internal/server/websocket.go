@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// handleConnect accepts a tunnel carried over a WebSocket on the public
+// listener, for clients whose network only lets HTTP(S) out. On a tunnel's
+// own host the path belongs to the local service and is proxied as usual.
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if s.lookupSubdomain(r.Host) != "" {
+		s.handleHTTP(w, r)
+		return
+	}
+
+	ip := s.clientIP(r)
+	websocket.Server{
+		// Tunnel clients are not browsers, so there is no origin to
+		// check.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			// The connection ends when this returns, so stay for the
+			// lifetime of the tunnel.
+			s.handleNewTunnel(&wsConn{Conn: ws, remote: ip})
+		},
+	}.ServeHTTP(w, r)
+}
+
+// wsConn reports the visitor address of a WebSocket tunnel, where
+// websocket.Conn would give its origin, so per-IP limits apply to it too.
+type wsConn struct {
+	*websocket.Conn
+	remote string
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(c.remote)}
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// copyBufferSize matches io.Copy's default buffer.
+const copyBufferSize = 32 << 10
+
+var (
+	copyBuffers = sync.Pool{New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	}}
+	readers sync.Pool
+	writers sync.Pool
+)
+
+// Copy is io.Copy with a pooled buffer. Like io.Copy it hands off to
+// ReaderFrom or WriterTo when either side has one, so TCP to TCP copies can
+// avoid user space altogether.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// NewReader returns a pooled bufio.Reader reading from r. Return it with
+// PutReader once nothing reads from it any more.
+func NewReader(r io.Reader) *bufio.Reader {
+	if br, ok := readers.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// PutReader returns br to the pool.
+func PutReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readers.Put(br)
+}
+
+// MessageWriter writes an HTTP message onto a stream through a pooled
+// buffer, so the start line, headers and a small body go out as one frame.
+// Wrap the message body with Body so that buffered data is flushed whenever
+// the body is about to block, which keeps streamed bodies streaming.
+type MessageWriter struct {
+	bw *bufio.Writer
+}
+
+// NewMessageWriter returns a MessageWriter for w. Call Release when done.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	bw, ok := writers.Get().(*bufio.Writer)
+	if ok {
+		bw.Reset(w)
+	} else {
+		bw = bufio.NewWriter(w)
+	}
+	return &MessageWriter{bw: bw}
+}
+
+// Body wraps the body of the message being written.
+func (m *MessageWriter) Body(body io.ReadCloser) io.ReadCloser {
+	return flushingBody{ReadCloser: body, w: m.bw}
+}
+
+func (m *MessageWriter) Write(p []byte) (int, error)       { return m.bw.Write(p) }
+func (m *MessageWriter) WriteString(s string) (int, error) { return m.bw.WriteString(s) }
+
+// WriteByte lets http.Request.Write use m directly instead of adding a
+// buffer of its own.
+func (m *MessageWriter) WriteByte(c byte) error { return m.bw.WriteByte(c) }
+
+// ReadFrom copies a body through a pooled buffer. bufio.Writer.ReadFrom
+// would read straight into its own buffer, which a flushing body then
+// rewrites underneath it.
+func (m *MessageWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	var n int64
+	for {
+		nr, err := r.Read(*buf)
+		if nr > 0 {
+			nw, werr := m.bw.Write((*buf)[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Flush writes any buffered data to the stream.
+func (m *MessageWriter) Flush() error {
+	return m.bw.Flush()
+}
+
+// Release returns the buffer to the pool, dropping anything not flushed. m
+// must not be used afterwards.
+func (m *MessageWriter) Release() {
+	m.bw.Reset(nil)
+	writers.Put(m.bw)
+	m.bw = nil
+}
+
+type flushingBody struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (b flushingBody) Read(p []byte) (int, error) {
+	if err := b.w.Flush(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
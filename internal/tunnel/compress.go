@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CompressionGzip is the only payload compression so far, offered in
+// Handshake.Compression and chosen in HandshakeResp.Compression.
+const CompressionGzip = "gzip"
+
+// Headers marking a message body compressed for the trip through the tunnel.
+// They never leave the tunnel: the receiving side removes them and restores
+// the body as the sender got it.
+const (
+	EncodingHeader = "Openport-Encoding"
+	LengthHeader   = "Openport-Length" // the uncompressed length, when known
+)
+
+// minCompressSize is the smallest known body worth compressing. Below it the
+// gzip header and a flush cost more than they save.
+const minCompressSize = 1 << 10
+
+// CompressionStats counts body bytes before and after compression, for
+// bodies that were compressed.
+type CompressionStats struct {
+	Raw  atomic.Uint64
+	Wire atomic.Uint64
+}
+
+// Ratio returns how many times smaller compressed bodies were on the wire,
+// or 0 before any body was compressed.
+func (s *CompressionStats) Ratio() float64 {
+	wire := s.Wire.Load()
+	if wire == 0 {
+		return 0
+	}
+	return float64(s.Raw.Load()) / float64(wire)
+}
+
+var (
+	gzipWriters sync.Pool
+	gzipReaders sync.Pool
+)
+
+// Compressible reports whether a body with header h and length (-1 when
+// unknown) is worth compressing. Bodies that are already encoded, short, or
+// of a type that is compressed by nature are sent as they are.
+func Compressible(h http.Header, length int64) bool {
+	if length >= 0 && length < minCompressSize {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get(EncodingHeader) != "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		// Unlabelled bodies are left alone; they are as often binary
+		// as not.
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"), mt == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "audio/"),
+		strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "font/"):
+		return false
+	case strings.HasPrefix(mt, "application/grpc"):
+		// gRPC compresses messages itself, and its framing must not be
+		// held back by a compressor.
+		return false
+	case strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	switch mt {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-www-form-urlencoded", "application/graphql",
+		"application/wasm", "application/x-ndjson":
+		return true
+	}
+	return false
+}
+
+// CompressBody returns body gzipped on the fly, marking h accordingly, with
+// the length to send in its place (-1, as the compressed size is unknown
+// up front). Every chunk read from body is flushed through at once so
+// streamed responses keep streaming. Bytes are counted in stats, if set.
+func CompressBody(h http.Header, body io.ReadCloser, length int64, stats *CompressionStats) (io.ReadCloser, int64) {
+	h.Set(EncodingHeader, CompressionGzip)
+	if length >= 0 {
+		h.Set(LengthHeader, strconv.FormatInt(length, 10))
+	}
+	h.Del("Content-Length")
+
+	gb := &gzipBody{src: body, stats: stats}
+	if zw, ok := gzipWriters.Get().(*gzip.Writer); ok {
+		zw.Reset(&gb.buf)
+		gb.zw = zw
+	} else {
+		gb.zw, _ = gzip.NewWriterLevel(&gb.buf, gzip.BestSpeed)
+	}
+	return gb, -1
+}
+
+// gzipBody reads its source through a gzip.Writer, handing out whatever the
+// writer has produced so far.
+type gzipBody struct {
+	src   io.ReadCloser
+	zw    *gzip.Writer
+	buf   bytes.Buffer
+	done  bool
+	stats *CompressionStats
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		if err := b.fill(len(p)); err != nil {
+			return 0, err
+		}
+	}
+	n, _ := b.buf.Read(p)
+	if b.stats != nil {
+		b.stats.Wire.Add(uint64(n))
+	}
+	return n, nil
+}
+
+// fill compresses one read of the source.
+func (b *gzipBody) fill(size int) error {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	n, err := b.src.Read((*buf)[:min(max(size, 512), len(*buf))])
+	if n > 0 {
+		if b.stats != nil {
+			b.stats.Raw.Add(uint64(n))
+		}
+		if _, werr := b.zw.Write((*buf)[:n]); werr != nil {
+			return werr
+		}
+	}
+	switch {
+	case err == io.EOF:
+		b.done = true
+		return b.zw.Close()
+	case err != nil:
+		return err
+	case n > 0:
+		return b.zw.Flush()
+	}
+	return nil
+}
+
+func (b *gzipBody) Close() error {
+	if b.zw != nil {
+		b.zw.Reset(nil)
+		gzipWriters.Put(b.zw)
+		b.zw = nil
+	}
+	return b.src.Close()
+}
+
+// DecompressBody undoes CompressBody on the receiving side. When h marks
+// the body as compressed, it removes the marks and returns the decompressed
+// body with its original length (-1 when unknown) and true. Otherwise body
+// is returned unchanged with false.
+func DecompressBody(h http.Header, body io.ReadCloser) (io.ReadCloser, int64, bool) {
+	if h.Get(EncodingHeader) != CompressionGzip {
+		return body, -1, false
+	}
+	length := int64(-1)
+	if n, err := strconv.ParseInt(h.Get(LengthHeader), 10, 64); err == nil && n >= 0 {
+		length = n
+		h.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+	h.Del(EncodingHeader)
+	h.Del(LengthHeader)
+	return &gunzipBody{src: body}, length, true
+}
+
+// gunzipBody starts decompressing on the first Read, so that a streamed body
+// whose first bytes are slow to come does not hold back its headers.
+type gunzipBody struct {
+	src io.ReadCloser
+	zr  *gzip.Reader
+}
+
+func (b *gunzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil {
+		var err error
+		if zr, ok := gzipReaders.Get().(*gzip.Reader); ok {
+			err = zr.Reset(b.src)
+			b.zr = zr
+		} else {
+			b.zr, err = gzip.NewReader(b.src)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gunzipBody) Close() error {
+	if b.zr != nil {
+		gzipReaders.Put(b.zr)
+		b.zr = nil
+	}
+	return b.src.Close()
+}
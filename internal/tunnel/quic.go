@@ -0,0 +1,267 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the ALPN protocol of tunnels carried over QUIC.
+const QUICProtocol = "openport"
+
+// maxQUICStreams bounds the requests in flight on one QUIC tunnel. yamux has
+// no such limit, so it is set well above what a tunnel sees in practice.
+const maxQUICStreams = 1 << 14
+
+// A dialed QUIC connection checks every addrCheckInterval whether the local
+// address it would reach the server from has changed, and if so migrates,
+// giving the new path migrateTimeout to answer.
+const (
+	addrCheckInterval = 2 * time.Second
+	migrateTimeout    = 5 * time.Second
+)
+
+// QUICConfig returns the QUIC configuration for a tunnel, with window
+// interpreted as in SessionConfig. Keep-alives hold NAT mappings open.
+func QUICConfig(window uint32) *quic.Config {
+	return &quic.Config{
+		InitialStreamReceiveWindow: uint64(min(max(window, MinStreamWindow), MaxStreamWindow)),
+		MaxStreamReceiveWindow:     MaxStreamWindow,
+		MaxIncomingStreams:         maxQUICStreams,
+		KeepAlivePeriod:            15 * time.Second,
+	}
+}
+
+// DialQUIC connects to a server's QUIC listener at addr and opens the
+// control stream, on which the handshake is then exchanged as on a TCP
+// connection. When the local address changes, as when a laptop moves from
+// Wi-Fi to a phone's hotspot, the connection migrates to the new network.
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, window uint32) (*QUICConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialQUIC(ctx, pc, raddr, tlsConf, window)
+	if err != nil {
+		return nil, err
+	}
+	go c.watchAddr()
+	return c, nil
+}
+
+// dialQUIC is DialQUIC over pc, which it closes on failure or once the
+// connection ends.
+func dialQUIC(ctx context.Context, pc net.PacketConn, addr *net.UDPAddr, tlsConf *tls.Config, window uint32) (*QUICConn, error) {
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{QUICProtocol}
+	tr := &quic.Transport{Conn: pc}
+	conn, err := tr.Dial(ctx, addr, tlsConf, QUICConfig(window))
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+	c := &QUICConn{Stream: control, conn: conn, remote: addr, transports: []*quic.Transport{tr}}
+	go func() {
+		<-conn.Context().Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, tr := range c.transports {
+			tr.Close()
+			tr.Conn.Close()
+		}
+		c.transports = nil
+	}()
+	return c, nil
+}
+
+// AcceptQUIC waits for the control stream of a connection accepted by a
+// QUIC listener.
+func AcceptQUIC(ctx context.Context, conn *quic.Conn) (*QUICConn, error) {
+	control, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &QUICConn{Stream: control, conn: conn}, nil
+}
+
+// QUICConn is a tunnel connection over QUIC, read and written through its
+// control stream. Closing it closes the whole connection. ServerSession and
+// ClientSession turn it into a Session whose streams are QUIC streams, so a
+// stalled request does not hold up the others.
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+
+	// Dialed connections only: the server's address, and the transports
+	// of every path used so far. Closing a transport ends the connections
+	// it started, so those the connection has moved off stay open until it
+	// ends.
+	remote     *net.UDPAddr
+	mu         sync.Mutex
+	transports []*quic.Transport
+}
+
+func (c *QUICConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *QUICConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *QUICConn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+// watchAddr migrates the connection whenever the address this host would
+// reach the server from changes, until the connection ends.
+func (c *QUICConn) watchAddr() {
+	ticker := time.NewTicker(addrCheckInterval)
+	defer ticker.Stop()
+	last := localIP(c.remote)
+	for {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		ip := localIP(c.remote)
+		if ip == nil || ip.Equal(last) {
+			continue
+		}
+		pc, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			continue
+		}
+		// A path that fails its probe is not tried again: the old one
+		// has usually gone too, and the client reconnects once the
+		// connection times out.
+		last = ip
+		ctx, cancel := context.WithTimeout(c.conn.Context(), migrateTimeout)
+		c.migrate(ctx, pc)
+		cancel()
+	}
+}
+
+// migrate moves the connection onto pc: the server must answer a probe on
+// the new path before traffic is switched to it. pc is closed along with
+// the connection, or at once if the path can't be added.
+func (c *QUICConn) migrate(ctx context.Context, pc net.PacketConn) error {
+	tr := &quic.Transport{Conn: pc}
+	path, err := c.conn.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return err
+	}
+	// The transport now routes packets to the connection, so closing it
+	// would end the connection; it is closed along with the others.
+	c.mu.Lock()
+	ended := c.transports == nil
+	if !ended {
+		c.transports = append(c.transports, tr)
+	}
+	c.mu.Unlock()
+	if ended {
+		tr.Close()
+		pc.Close()
+		return net.ErrClosed
+	}
+
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return err
+	}
+	return path.Switch()
+}
+
+// localIP returns the address this host sends from to reach remote, or nil
+// when there is no route. Connecting a UDP socket sends nothing.
+func localIP(remote *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp", nil, remote)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (c *QUICConn) session() Session {
+	s := &quicSession{QUICConn: c}
+	go s.watchGoAway()
+	return s
+}
+
+// quicSession implements Session on a QUIC connection. After the handshake
+// the control stream only carries GoAway.
+type quicSession struct {
+	*QUICConn
+	goAway atomic.Bool
+}
+
+func (s *quicSession) watchGoAway() {
+	var b [1]byte
+	if n, _ := s.Stream.Read(b[:]); n > 0 {
+		s.goAway.Store(true)
+	}
+}
+
+func (s *quicSession) Open() (net.Conn, error) {
+	if s.goAway.Load() {
+		return nil, ErrGoAway
+	}
+	stream, err := s.conn.OpenStreamSync(s.conn.Context())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: s.conn}, nil
+}
+
+func (s *quicSession) Accept() (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: s.conn}, nil
+}
+
+func (s *quicSession) GoAway() error {
+	_, err := s.Stream.Write([]byte{0})
+	return err
+}
+
+func (s *quicSession) CloseChan() <-chan struct{} {
+	return s.conn.Context().Done()
+}
+
+func (s *quicSession) IsClosed() bool {
+	return s.conn.Context().Err() != nil
+}
+
+// quicStream is a QUIC stream as a net.Conn. Close also stops reading, as
+// QUIC only releases a stream once both directions are done and not every
+// body is read to the end.
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// TestQUICMigration moves the client onto a new UDP socket in the middle of
+// a request, with the old one dropping everything from then on, as when a
+// laptop leaves one network for another.
+func TestQUICMigration(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCert(t)},
+		NextProtos:   []string{QUICProtocol},
+	}, QUICConfig(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The server echoes one stream and reports where the client was by
+	// the end of it.
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		qc, err := AcceptQUIC(context.Background(), conn)
+		if err != nil {
+			return
+		}
+		if _, err := ReadHandshake(qc); err != nil {
+			return
+		}
+		stream, err := qc.session().Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		remote <- conn.RemoteAddr()
+		stream.Close()
+	}()
+
+	old := listenDroppable(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	qc, err := dialQUIC(ctx, old, ln.Addr().(*net.UDPAddr), &tls.Config{InsecureSkipVerify: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qc.Close()
+	if err := SendHandshake(qc, Handshake{Version: ProtocolVersion}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := qc.session().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := io.WriteString(stream, msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(stream, got); err != nil || string(got) != msg {
+			t.Fatalf("echo of %q: got %q, %v", msg, got, err)
+		}
+	}
+
+	echo("before")
+	old.drop.Store(true)
+	moved, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qc.migrate(ctx, moved); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	echo("after")
+	// Finish the request; closing the QUIC stream itself ends only our side.
+	stream.(*quicStream).Stream.Close()
+
+	select {
+	case addr := <-remote:
+		if addr.String() != moved.LocalAddr().String() {
+			t.Fatalf("server saw the client at %s, want %s", addr, moved.LocalAddr())
+		}
+	case <-ctx.Done():
+		t.Fatal("request did not finish after migrating")
+	}
+}
+
+// droppablePacketConn is a UDP socket that silently loses every packet once
+// drop is set. It hides the UDPConn methods quic-go would otherwise use to
+// go around ReadFrom and WriteTo.
+type droppablePacketConn struct {
+	net.PacketConn
+	drop atomic.Bool
+}
+
+func listenDroppable(t *testing.T) *droppablePacketConn {
+	t.Helper()
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &droppablePacketConn{PacketConn: pc}
+}
+
+func (c *droppablePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.drop.Load() {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *droppablePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.drop.Load() {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func testCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"log"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Session multiplexes the streams of one tunnel over a single connection.
+// The server opens a stream per public request and the client accepts them.
+// *yamux.Session implements it for TCP and WebSocket connections; QUIC
+// connections carry each stream natively.
+type Session interface {
+	Open() (net.Conn, error)
+	Accept() (net.Conn, error)
+
+	// GoAway tells the peer to open no new streams, while those already
+	// open carry on.
+	GoAway() error
+
+	Close() error
+	CloseChan() <-chan struct{}
+	IsClosed() bool
+}
+
+// ErrGoAway is returned by Session.Open after the peer called GoAway.
+var ErrGoAway = yamux.ErrRemoteGoAway
+
+// ServerSession starts the server's side of the session on conn, once the
+// handshake is done.
+func ServerSession(conn net.Conn, window uint32) (Session, error) {
+	if qc, ok := conn.(*QUICConn); ok {
+		return qc.session(), nil
+	}
+	session, err := yamux.Client(conn, SessionConfig(window))
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// ClientSession starts the client's side of the session on conn, once the
+// handshake is done.
+func ClientSession(conn net.Conn, window uint32) (Session, error) {
+	if qc, ok := conn.(*QUICConn); ok {
+		return qc.session(), nil
+	}
+	session, err := yamux.Server(conn, SessionConfig(window))
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Bounds on the per-stream receive window. yamux refuses anything smaller
+// than its default, and the ceiling caps how much memory one slow stream can
+// pin on the receiving side.
+const (
+	MinStreamWindow = 256 << 10
+	MaxStreamWindow = 16 << 20
+)
+
+// SessionConfig returns the yamux configuration for a tunnel session. Each
+// stream may have up to window bytes in flight before the sender waits,
+// which matters for large uploads over links with high latency. Zero keeps
+// the minimum; other values are clamped to [MinStreamWindow,
+// MaxStreamWindow].
+func SessionConfig(window uint32) *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.MaxStreamWindowSize = min(max(window, MinStreamWindow), MaxStreamWindow)
+	// Route yamux warnings through the standard logger like ours.
+	cfg.LogOutput = nil
+	cfg.Logger = log.Default()
+	return cfg
+}
@@ -1,24 +1,161 @@
 package tunnel
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
-	"github.com/hashicorp/yamux"
+	"github.com/nitintf/openport/internal/ratelimit"
 )
 
+// ProtocolVersion is the version of the wire protocol spoken over a tunnel.
+// It goes up whenever clients and servers of different releases would no
+// longer understand each other, as when streams gained their StreamKind
+// prefix; before that, handshakes carried no version at all.
+const ProtocolVersion = 1
+
 // Handshake is the initial message a client sends to register a tunnel.
 type Handshake struct {
+	// Version is the ProtocolVersion the client speaks. The server refuses
+	// other versions with CodeUnsupported.
+	Version int `json:"version,omitempty"`
+
+	Type      string `json:"type,omitempty"` // TypeHTTP (default), TypeTLS or TypeUDP
 	Subdomain string `json:"subdomain,omitempty"`
+	Token     string `json:"token,omitempty"`
+
+	// RateLimit and RateBurst request a per-tunnel request limit. The server
+	// caps them at its configured ceiling.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	RateBurst int     `json:"rate_burst,omitempty"`
+
+	// BandwidthLimit requests per-tunnel shaping in bytes per second.
+	BandwidthLimit int64 `json:"bandwidth_limit,omitempty"`
+
+	// Pool asks to share the subdomain with other clients using the same
+	// token. Balance ("round-robin" or "least-in-flight") and Sticky are
+	// taken from the first member.
+	Pool    bool   `json:"pool,omitempty"`
+	Balance string `json:"balance,omitempty"`
+	Sticky  bool   `json:"sticky,omitempty"`
+
+	// Domains are custom hostnames to bind to the tunnel. Each must have a
+	// TXT record proving ownership; see DomainVerification.
+	Domains []string `json:"domains,omitempty"`
+
+	// DomainRecords asks for the TXT record values of Domains instead of
+	// opening a tunnel. The server answers and closes the connection.
+	DomainRecords bool `json:"domain_records,omitempty"`
+
+	// Compression lists the payload compressions the client can use, in
+	// order of preference.
+	Compression []string `json:"compression,omitempty"`
+
+	// E2E marks a TLS tunnel whose client terminates TLS and serves HTTP
+	// itself, so the server only ever relays ciphertext. Its public URL is
+	// https://, plain HTTP requests are redirected there, and ACME HTTP-01
+	// challenges for its hosts are passed to the client.
+	E2E bool `json:"e2e,omitempty"`
 }
 
 // HandshakeResp is the server's response after registering the tunnel.
 type HandshakeResp struct {
+	Version   int    `json:"version,omitempty"` // the server's ProtocolVersion
 	Subdomain string `json:"subdomain"`
 	URL       string `json:"url"`
 	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+
+	// Domains holds the public URLs of the bound custom domains.
+	Domains []string `json:"domains,omitempty"`
+
+	// DomainRecords holds the TXT record values asked for with
+	// Handshake.DomainRecords, one per domain in order.
+	DomainRecords []string `json:"domain_records,omitempty"`
+
+	// Compression is the compression chosen from Handshake.Compression,
+	// or empty when bodies are sent as they are.
+	Compression string `json:"compression,omitempty"`
+
+	// ACMEDirectory is the ACME directory the server uses, offered to E2E
+	// clients for their own certificates. Empty means Let's Encrypt.
+	ACMEDirectory string `json:"acme_directory,omitempty"`
+}
+
+// ACMEChallengePath prefixes the URLs at which ACME HTTP-01 challenges are
+// answered.
+const ACMEChallengePath = "/.well-known/acme-challenge/"
+
+// ConnectPath is where the server's public listener accepts tunnels carried
+// over a WebSocket, for clients that cannot reach the tunnel port.
+const ConnectPath = "/_openport/connect"
+
+// DomainRecordPrefix is prepended to a custom domain to name the TXT record
+// checked for ownership, e.g. _openport.dev.example.com.
+const DomainRecordPrefix = "_openport."
+
+// DomainVerification returns the TXT record value that lets clients holding
+// token bind domain on a server with key. It is an HMAC under the server's
+// key, so without the key the published value can't be computed or checked
+// against guessed tokens; clients ask the server for theirs (see
+// Handshake.DomainRecords).
+func DomainVerification(key []byte, token, domain string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	mac.Write([]byte{0})
+	mac.Write([]byte(domain))
+	return "openport-verify=" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Error codes sent in HandshakeResp.Code and Notice.Code so clients can tell
+// failures apart without parsing messages.
+const (
+	CodeSubdomainTaken   = "subdomain_taken"
+	CodeUnauthorized     = "unauthorized"
+	CodeTooManyTunnels   = "too_many_tunnels"
+	CodeIdleTimeout      = "idle_timeout"
+	CodeLifetimeExceeded = "lifetime_exceeded"
+	CodeDomainUnverified = "domain_unverified"
+	CodeDomainTaken      = "domain_taken"
+	CodeUnsupported      = "unsupported"
+	CodePortsExhausted   = "ports_exhausted"
+)
+
+// Tunnel types, sent in Handshake.Type.
+const (
+	TypeHTTP = "http" // the server terminates HTTP and forwards requests
+	TypeTLS  = "tls"  // the server relays TLS connections by SNI, undecrypted
+	TypeUDP  = "udp"  // the server relays datagrams from a public UDP port
+)
+
+// Load balancing strategies for shared pools, sent in Handshake.Balance.
+const (
+	BalanceRoundRobin    = "round-robin"
+	BalanceLeastInFlight = "least-in-flight"
+)
+
+// StreamKind is the first byte of every stream the server opens, telling the
+// client how to handle the rest of it.
+type StreamKind byte
+
+const (
+	StreamHTTP   StreamKind = 1 // an HTTP/1.1 request, answered with a response
+	StreamNotice StreamKind = 2 // a JSON Notice from the server
+	StreamTLS    StreamKind = 3 // a raw TLS connection, starting with its ClientHello
+	StreamUDP    StreamKind = 4 // datagrams from one UDP peer, framed with WriteDatagram
+)
+
+// Notice is sent by the server before it closes a tunnel on its own accord.
+type Notice struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 // Tunnel represents an active tunnel connection between the server and a client.
@@ -26,47 +163,190 @@ type Tunnel struct {
 	ID        string
 	Subdomain string
 	Conn      net.Conn
-	Session   *yamux.Session
+	Session   Session
+	Limiter   *ratelimit.Limiter
+	Bandwidth *ratelimit.Limiter
+	Created   time.Time
+	Stats     Stats
+
+	// Compression is the payload compression agreed in the handshake.
+	Compression string
+
+	// InFlight counts requests currently being proxied.
+	InFlight atomic.Int64
+
+	lastActive atomic.Int64
+}
+
+// Touch marks the tunnel as active now.
+func (t *Tunnel) Touch() {
+	t.lastActive.Store(time.Now().UnixNano())
 }
 
+// IdleFor reports how long the tunnel has had no requests in flight.
+func (t *Tunnel) IdleFor() time.Duration {
+	if t.InFlight.Load() > 0 {
+		return 0
+	}
+	last := t.lastActive.Load()
+	if last == 0 {
+		return time.Since(t.Created)
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// Stats counts the bytes moved through a tunnel. BytesIn flows from the public
+// side towards the local service, BytesOut flows back.
+type Stats struct {
+	BytesIn  atomic.Uint64
+	BytesOut atomic.Uint64
+}
+
+// Meter wraps conn so every byte read or written is added to the given
+// counters and paced by limiter. Nil counters and a nil limiter are skipped.
+func Meter(conn net.Conn, read, written *atomic.Uint64, limiter *ratelimit.Limiter) net.Conn {
+	return &meteredConn{Conn: conn, read: read, written: written, limiter: limiter}
+}
+
+type meteredConn struct {
+	net.Conn
+	read    *atomic.Uint64
+	written *atomic.Uint64
+	limiter *ratelimit.Limiter
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if c.read != nil {
+			c.read.Add(uint64(n))
+		}
+		c.limiter.WaitN(n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	c.limiter.WaitN(len(p))
+	n, err := c.Conn.Write(p)
+	if n > 0 && c.written != nil {
+		c.written.Add(uint64(n))
+	}
+	return n, err
+}
+
+// MaxHandshakeSize bounds a handshake message, so a peer cannot make the
+// other side buffer without limit before the session starts.
+const MaxHandshakeSize = 64 << 10
+
 // SendHandshake writes a handshake message to the connection.
-func SendHandshake(conn net.Conn, h Handshake) error {
-	return json.NewEncoder(conn).Encode(h)
+func SendHandshake(w io.Writer, h Handshake) error {
+	return json.NewEncoder(w).Encode(h)
 }
 
 // ReadHandshake reads a handshake message from the connection.
-func ReadHandshake(conn net.Conn) (Handshake, error) {
+func ReadHandshake(r io.Reader) (Handshake, error) {
 	var h Handshake
-	if err := json.NewDecoder(conn).Decode(&h); err != nil {
+	if err := readMessage(r, &h); err != nil {
 		return h, fmt.Errorf("read handshake: %w", err)
 	}
 	return h, nil
 }
 
 // SendHandshakeResp writes a handshake response to the connection.
-func SendHandshakeResp(conn net.Conn, resp HandshakeResp) error {
-	return json.NewEncoder(conn).Encode(resp)
+func SendHandshakeResp(w io.Writer, resp HandshakeResp) error {
+	return json.NewEncoder(w).Encode(resp)
 }
 
 // ReadHandshakeResp reads a handshake response from the connection.
-func ReadHandshakeResp(conn net.Conn) (HandshakeResp, error) {
+func ReadHandshakeResp(r io.Reader) (HandshakeResp, error) {
 	var resp HandshakeResp
-	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+	if err := readMessage(r, &resp); err != nil {
 		return resp, fmt.Errorf("read handshake response: %w", err)
 	}
 	return resp, nil
 }
 
+// readMessage decodes one newline-terminated JSON message, as written by
+// json.Encoder. It reads a byte at a time so nothing past the newline is
+// consumed: the multiplexed session starts right after it. Messages over
+// MaxHandshakeSize are rejected.
+func readMessage(r io.Reader, v any) error {
+	var line []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) == MaxHandshakeSize {
+			return fmt.Errorf("message exceeds %d bytes", MaxHandshakeSize)
+		}
+		line = append(line, b[0])
+	}
+	return json.Unmarshal(line, v)
+}
+
+// WriteStreamKind writes the stream kind header.
+func WriteStreamKind(w io.Writer, k StreamKind) error {
+	_, err := w.Write([]byte{byte(k)})
+	return err
+}
+
+// ReadStreamKind reads the stream kind header.
+func ReadStreamKind(r io.Reader) (StreamKind, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, fmt.Errorf("read stream kind: %w", err)
+	}
+	return StreamKind(b[0]), nil
+}
+
+// MaxDatagramSize is the largest UDP payload that can be framed.
+const MaxDatagramSize = 65535
+
+// WriteDatagram writes p as one length-prefixed frame. The first frame on a
+// StreamUDP stream carries the peer's address.
+func WriteDatagram(w io.Writer, p []byte) error {
+	if len(p) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(p))
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads one frame written by WriteDatagram into buf, which must
+// hold MaxDatagramSize bytes, and returns the payload.
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
 // Relay copies data bidirectionally between two connections.
 func Relay(a, b io.ReadWriteCloser) error {
 	errc := make(chan error, 2)
 
 	go func() {
-		_, err := io.Copy(a, b)
+		_, err := Copy(a, b)
 		errc <- err
 	}()
 	go func() {
-		_, err := io.Copy(b, a)
+		_, err := Copy(b, a)
 		errc <- err
 	}()
 
@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+// The session starts right after the handshake, often in the same TCP
+// segment, so reading the handshake must leave those bytes in place.
+func TestReadHandshakeLeavesSessionBytes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SendHandshakeResp(&buf, HandshakeResp{Subdomain: "app", URL: "http://app.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("\x00\x01session")
+
+	resp, err := ReadHandshakeResp(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Subdomain != "app" {
+		t.Fatalf("got subdomain %q, want app", resp.Subdomain)
+	}
+	if rest := buf.String(); rest != "\x00\x01session" {
+		t.Fatalf("remaining bytes %q, want the session preamble", rest)
+	}
+}
+
+func TestReadHandshakeTooLarge(t *testing.T) {
+	msg := `{"subdomain":"` + strings.Repeat("a", MaxHandshakeSize) + `"}` + "\n"
+	r := strings.NewReader(msg)
+	if _, err := ReadHandshake(r); err == nil {
+		t.Fatal("oversized handshake accepted")
+	}
+	if read := len(msg) - r.Len(); read > MaxHandshakeSize+1 {
+		t.Fatalf("read %d bytes of an oversized handshake", read)
+	}
+}
+
+func FuzzReadHandshake(f *testing.F) {
+	f.Add([]byte(`{"subdomain":"app","token":"t"}`+"\n"), []byte("rest"))
+	f.Add([]byte(`{"type":"udp","domains":["a.example.com"]}`+"\n"), []byte{})
+	f.Add([]byte(`{"subdomain":"a\nb"}`), []byte("\n"))
+	f.Add([]byte("\n"), []byte("{}"))
+	f.Add([]byte(`{"pool":true,"rate_limit":1e400}`+"\n"), []byte{0})
+
+	f.Fuzz(func(t *testing.T, msg, rest []byte) {
+		r := bytes.NewReader(append(msg[:len(msg):len(msg)], rest...))
+		_, err := ReadHandshake(r)
+		if err != nil {
+			return
+		}
+		// A message is accepted only up to its first newline, and
+		// nothing after it may be consumed.
+		i := bytes.IndexByte(msg, '\n')
+		if i < 0 {
+			i = len(msg) + bytes.IndexByte(rest, '\n')
+		}
+		if consumed := int(r.Size()) - r.Len(); consumed != i+1 {
+			t.Fatalf("consumed %d bytes, message ends at %d", consumed, i+1)
+		}
+	})
+}
+
+func FuzzHandshakeRoundTrip(f *testing.F) {
+	f.Add("http", "app", "tok", 10.5, 20, int64(1024), true, "a.example.com")
+	f.Add("", "", "", 0.0, 0, int64(0), false, "")
+	f.Add("tls", "x\ny", " ", -1.0, -1, int64(-1), false, "\x00")
+
+	f.Fuzz(func(t *testing.T, typ, sub, token string, rate float64, burst int, bw int64, pool bool, domain string) {
+		h := Handshake{
+			Type:           typ,
+			Subdomain:      sub,
+			Token:          token,
+			RateLimit:      rate,
+			RateBurst:      burst,
+			BandwidthLimit: bw,
+			Pool:           pool,
+		}
+		if domain != "" {
+			h.Domains = []string{domain}
+		}
+
+		var buf bytes.Buffer
+		if err := SendHandshake(&buf, h); err != nil {
+			t.Skip(err) // NaN and infinite rates have no JSON form
+		}
+		if buf.Len() > MaxHandshakeSize {
+			t.Skip("over the size limit")
+		}
+		buf.WriteString("after")
+
+		got, err := ReadHandshake(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validUTF8(typ, sub, token, domain) {
+			// JSON replaces invalid UTF-8, so only the framing can be
+			// checked.
+			h, got = Handshake{}, Handshake{}
+		}
+		if !reflect.DeepEqual(got, h) {
+			t.Fatalf("got %+v, want %+v", got, h)
+		}
+		if buf.String() != "after" {
+			t.Fatalf("remaining bytes %q", buf.String())
+		}
+	})
+}
+
+func FuzzDatagram(f *testing.F) {
+	f.Add([]byte("hello"), 16)
+	f.Add([]byte{}, 0)
+	f.Add([]byte("too big"), 3)
+
+	f.Fuzz(func(t *testing.T, p []byte, size int) {
+		if size < 0 || size > MaxDatagramSize {
+			size = MaxDatagramSize
+		}
+		var stream bytes.Buffer
+		if err := WriteDatagram(&stream, p); err != nil {
+			if len(p) <= MaxDatagramSize {
+				t.Fatalf("WriteDatagram: %v", err)
+			}
+			return
+		}
+
+		got, err := ReadDatagram(&stream, make([]byte, size))
+		if len(p) > size {
+			if err != io.ErrShortBuffer {
+				t.Fatalf("got %v for a %d byte datagram in a %d byte buffer", err, len(p), size)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, p) {
+			t.Fatalf("got %q, want %q", got, p)
+		}
+	})
+}
+
+func validUTF8(ss ...string) bool {
+	for _, s := range ss {
+		if !utf8.ValidString(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// A body flushed from inside bufio.Writer.ReadFrom used to send the headers
+// a second time in place of the body.
+func TestMessageWriterKnownLength(t *testing.T) {
+	var stream bytes.Buffer
+	mw := NewMessageWriter(&stream)
+	defer mw.Release()
+
+	body := "hello, world"
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Body:          mw.Body(io.NopCloser(strings.NewReader(body))),
+		ContentLength: int64(len(body)),
+	}
+	if err := resp.Write(mw); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := http.ReadResponse(bufio.NewReader(&stream), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(got.Body); string(b) != body {
+		t.Fatalf("got body %q, want %q", b, body)
+	}
+}
+
+func FuzzCompressBody(f *testing.F) {
+	f.Add([]byte(strings.Repeat("hello ", 500)), true)
+	f.Add([]byte{}, false)
+	f.Add([]byte("\x1f\x8b"), true)
+
+	f.Fuzz(func(t *testing.T, body []byte, known bool) {
+		length := int64(-1)
+		if known {
+			length = int64(len(body))
+		}
+		h := http.Header{"Content-Length": {"1"}}
+		var stats CompressionStats
+		rc, wireLength := CompressBody(h, io.NopCloser(iotest.OneByteReader(bytes.NewReader(body))), length, &stats)
+		wire, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wireLength != -1 || h.Get("Content-Length") != "" {
+			t.Fatalf("compressed body keeps its length: %d, %q", wireLength, h.Get("Content-Length"))
+		}
+		if stats.Raw.Load() != uint64(len(body)) || stats.Wire.Load() != uint64(len(wire)) {
+			t.Fatalf("counted %d raw and %d wire bytes, want %d and %d", stats.Raw.Load(), stats.Wire.Load(), len(body), len(wire))
+		}
+
+		rc, gotLength, ok := DecompressBody(h, io.NopCloser(bytes.NewReader(wire)))
+		if !ok || gotLength != length {
+			t.Fatalf("DecompressBody = %d, %v, want %d, true", gotLength, ok, length)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatalf("got %q, want %q", got, body)
+		}
+		if h.Get(EncodingHeader) != "" || h.Get(LengthHeader) != "" {
+			t.Fatalf("tunnel headers left behind: %v", h)
+		}
+	})
+}
@@ -3,8 +3,10 @@ package ui
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/charmbracelet/lipgloss"
@@ -33,6 +35,10 @@ var (
 	arrowStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("241"))
 
+	e2eStyle = lipgloss.NewStyle().
+			Bold(true).
+			Foreground(lipgloss.Color("76"))
+
 	hintStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("241")).
 			Italic(true)
@@ -105,10 +111,27 @@ var (
 	checkStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("76")).
 			Render("✓")
+
+	// Traffic
+	trafficStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("245"))
+)
+
+var (
+	// outMu serialises writes so the live status line can be redrawn
+	// underneath request logs without interleaving.
+	outMu sync.Mutex
+
+	// status is the live status line, empty when not shown.
+	status string
+
+	// stopTraffic ends the live traffic counter, if running.
+	stopTraffic func()
 )
 
-// PrintBanner displays the startup tunnel information.
-func PrintBanner(tunnelURL, localAddr string) {
+// PrintBanner displays the startup tunnel information. e2e marks a tunnel
+// whose TLS op terminates itself.
+func PrintBanner(tunnelURL, localURL string, e2e bool, domainURLs ...string) {
 	fmt.Println()
 	fmt.Printf("  %s %s\n",
 		logoStyle.Render("openport"),
@@ -120,8 +143,18 @@ func PrintBanner(tunnelURL, localAddr string) {
 		labelStyle.Render("Forwarding"),
 		urlStyle.Render(tunnelURL),
 		arrowStyle.Render("→"),
-		urlStyle.Render("http://"+localAddr),
+		urlStyle.Render(localURL),
 	)
+	for _, u := range domainURLs {
+		fmt.Printf("  %s %s\n", labelStyle.Render(""), urlStyle.Render(u))
+	}
+	if e2e {
+		fmt.Printf("  %s %s %s\n",
+			labelStyle.Render("Encryption"),
+			e2eStyle.Render("🔒 end-to-end"),
+			hintStyle.Render("TLS ends in op; the server cannot read traffic"),
+		)
+	}
 	fmt.Println()
 	fmt.Printf("  %s\n", hintStyle.Render("Press Ctrl+C to stop"))
 
@@ -133,13 +166,95 @@ func PrintBanner(tunnelURL, localAddr string) {
 // PrintRequestLog renders a single styled request log line.
 func PrintRequestLog(r client.RequestLog) {
 	dot := statusDot(r.StatusCode)
-	status := statusCodeStyle(r.StatusCode).Render(strconv.Itoa(r.StatusCode))
+	code := statusCodeStyle(r.StatusCode).Render(strconv.Itoa(r.StatusCode))
 	method := methodStyle.Render(r.Method)
 	path := pathStyle.Render(r.Path)
 	dur := formatDuration(r.Duration)
 	ts := tsStyle.Render(r.Timestamp.Format("15:04:05"))
 
-	fmt.Printf("  %s %s %s %s %s %s\n", dot, ts, status, method, path, dur)
+	outMu.Lock()
+	defer outMu.Unlock()
+	clearStatus()
+	fmt.Printf("  %s %s %s %s %s %s\n", dot, ts, code, method, path, dur)
+	drawStatus()
+}
+
+// StartTraffic shows a live traffic counter below the request log and
+// refreshes it every second until StopTraffic is called. When ratio is set
+// and reports more than 0, the compression ratio is shown too. Nothing is
+// drawn when stdout is not a terminal.
+func StartTraffic(traffic func() (in, out uint64), ratio func() float64) {
+	if !isTerminal() {
+		return
+	}
+
+	update := func() {
+		in, out := traffic()
+		line := fmt.Sprintf("↓ %s in   ↑ %s out", formatBytes(in), formatBytes(out))
+		if ratio != nil {
+			if r := ratio(); r > 0 {
+				line += fmt.Sprintf("   gzip %.1f×", r)
+			}
+		}
+		outMu.Lock()
+		status = fmt.Sprintf("  %s %s",
+			labelStyle.Render("Traffic"),
+			trafficStyle.Render(line),
+		)
+		clearStatus()
+		drawStatus()
+		outMu.Unlock()
+	}
+	update()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				update()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	outMu.Lock()
+	stopTraffic = func() {
+		close(done)
+		clearStatus()
+		status = ""
+	}
+	outMu.Unlock()
+}
+
+// StopTraffic erases the live traffic counter started by StartTraffic.
+func StopTraffic() {
+	outMu.Lock()
+	defer outMu.Unlock()
+	if stopTraffic != nil {
+		stopTraffic()
+		stopTraffic = nil
+	}
+}
+
+func clearStatus() {
+	if status != "" {
+		fmt.Print("\r\033[K")
+	}
+}
+
+func drawStatus() {
+	if status != "" {
+		fmt.Print(status)
+	}
+}
+
+func isTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 // PrintError displays a human-friendly error message.
@@ -167,6 +282,64 @@ func PrintError(err error) {
 				fmt.Sprintf("The subdomain \"%s\" is already in use.", ce.Detail),
 				"Try a different subdomain with --subdomain or omit it for a random one.",
 			)
+		case errors.Is(ce.Kind, client.ErrUnauthorized):
+			printErrorBlock(
+				"Not authorized",
+				"The server rejected your auth token.",
+				"Pass a valid token with --token or the OPENPORT_TOKEN environment variable.",
+			)
+		case errors.Is(ce.Kind, client.ErrTooManyTunnels):
+			printErrorBlock(
+				"Too many tunnels",
+				fmt.Sprintf("The server refused another tunnel: %s.", ce.Detail),
+				"Close one of your other op sessions and try again.",
+			)
+		case errors.Is(ce.Kind, client.ErrDomainUnverified):
+			printErrorBlock(
+				"Domain not verified",
+				fmt.Sprintf("The server could not verify your domain: %s.", ce.Detail),
+				"Run op domain <domain> to see the record to publish, wait for DNS to update, then try again.",
+			)
+		case errors.Is(ce.Kind, client.ErrDomainTaken):
+			printErrorBlock(
+				"Domain in use",
+				fmt.Sprintf("The server refused the domain: %s.", ce.Detail),
+				"Stop the other tunnel using it, or pick a different domain.",
+			)
+		case errors.Is(ce.Kind, client.ErrUnsupported):
+			printErrorBlock(
+				"Not supported",
+				fmt.Sprintf("The server does not offer this tunnel: %s.", ce.Detail),
+				"Ask the server operator to enable it, or use a plain HTTP tunnel.",
+			)
+		case errors.Is(ce.Kind, client.ErrPortsExhausted):
+			printErrorBlock(
+				"No free port",
+				fmt.Sprintf("The server has no public port left for the tunnel: %s.", ce.Detail),
+				"Try again once other UDP tunnels have closed, or ask the server operator for a wider port range.",
+			)
+		case errors.Is(ce.Kind, client.ErrTunnelExpired):
+			printErrorBlock(
+				"Tunnel expired",
+				fmt.Sprintf("The server closed the tunnel: %s.", ce.Detail),
+				"Run op again to open a new tunnel.",
+			)
+		case errors.Is(ce.Kind, client.ErrProxy):
+			via := ""
+			if ce.Addr != "" {
+				via = " " + ce.Addr
+			}
+			printErrorBlock(
+				"Proxy failed",
+				fmt.Sprintf("Could not reach the server through the proxy%s: %s.", via, ce.Detail),
+				"Check the proxy address and credentials in --proxy, HTTPS_PROXY or ALL_PROXY.",
+			)
+		case errors.Is(ce.Kind, client.ErrCertificate):
+			printErrorBlock(
+				"Certificate unavailable",
+				fmt.Sprintf("No certificate for the end-to-end encrypted tunnel: %s.", ce.Detail),
+				"Pass one that covers the tunnel's host with --cert and --key, or check that the server forwards ACME challenges.",
+			)
 		case errors.Is(ce.Kind, client.ErrConnectionLost):
 			printErrorBlock(
 				"Connection lost",
@@ -224,6 +397,19 @@ func statusCodeStyle(code int) lipgloss.Style {
 	}
 }
 
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func formatDuration(d time.Duration) string {
 	d = d.Round(time.Millisecond)
 	if d < time.Second {
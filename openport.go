@@ -0,0 +1,148 @@
+// Package openport exposes services on a public URL through an openport
+// server, from inside a Go program.
+//
+// Listen returns a net.Listener whose connections come from the public
+// side of the tunnel, so any http.Server can serve on it:
+//
+//	l, err := openport.Listen(ctx, openport.Options{ServerAddr: "tunnel.example.com:9090"})
+//	if err != nil {
+//		return err
+//	}
+//	defer l.Close()
+//	log.Printf("serving on %s", l.URL())
+//	return http.Serve(l, handler)
+package openport
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/nitintf/openport/internal/client"
+)
+
+// DefaultServerAddr is the server used when Options.ServerAddr is empty.
+const DefaultServerAddr = "localhost:9090"
+
+// Options configure a tunnel opened by Listen.
+type Options struct {
+	ServerAddr string // openport server tunnel address (default DefaultServerAddr)
+	Subdomain  string // requested subdomain (random if empty)
+	Token      string // auth token presented to the server
+
+	// Domains are custom hostnames to bind, each verified by a DNS TXT
+	// record (see DomainRecord).
+	Domains []string
+
+	RateLimit float64 // requested requests per second (0 = server default)
+	RateBurst int
+	Bandwidth int64 // requested bytes per second (0 = server default)
+}
+
+// Listener is a net.Listener for the public side of a tunnel. Each accepted
+// connection carries HTTP/1.1 requests from visitors.
+type Listener struct {
+	c   *client.Client
+	l   net.Listener
+	url string
+
+	domains []string
+}
+
+// Listen opens a tunnel and returns once the server has assigned its public
+// URL. ctx bounds connecting only; use Close or Shutdown to end the tunnel.
+func Listen(ctx context.Context, opts Options) (*Listener, error) {
+	if opts.ServerAddr == "" {
+		opts.ServerAddr = DefaultServerAddr
+	}
+
+	c, err := client.New(client.Config{
+		ServerAddr: opts.ServerAddr,
+		Subdomain:  opts.Subdomain,
+		Token:      opts.Token,
+		Domains:    opts.Domains,
+		RateLimit:  opts.RateLimit,
+		RateBurst:  opts.RateBurst,
+		Bandwidth:  opts.Bandwidth,
+		Listen:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(context.Background()); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-c.Ready():
+		return &Listener{c: c, l: c.Listener(), url: c.TunnelURL, domains: c.DomainURLs}, nil
+	case <-c.Done():
+		return nil, c.Err()
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Accept waits for the next public connection. Once the tunnel is closed or
+// lost it returns the reason, or net.ErrClosed after Close.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.l.Accept()
+	if err != nil {
+		<-l.c.Done()
+		if err := l.c.Err(); !errors.Is(err, client.ErrClosed) {
+			return nil, err
+		}
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+// Close shuts the tunnel down. Connections already accepted are closed as
+// well, since they are carried by the tunnel.
+func (l *Listener) Close() error {
+	l.c.Close()
+	return nil
+}
+
+// Shutdown stops the server from sending new connections, then closes the
+// tunnel once ctx expires or the tunnel has drained. Shut down the
+// http.Server serving on l first, so that it finishes the requests it holds.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	return l.c.Shutdown(ctx)
+}
+
+// Done is closed when the tunnel has ended, whether by Close or because the
+// connection to the server was lost.
+func (l *Listener) Done() <-chan struct{} {
+	return l.c.Done()
+}
+
+// Addr returns the public address of the tunnel.
+func (l *Listener) Addr() net.Addr {
+	return addr(l.url)
+}
+
+// URL returns the public URL assigned by the server.
+func (l *Listener) URL() string {
+	return l.url
+}
+
+// DomainURLs returns the public URLs of the bound custom domains.
+func (l *Listener) DomainURLs() []string {
+	return l.domains
+}
+
+// DomainRecord asks the server at opts.ServerAddr for the name and value of
+// the DNS TXT record that lets a client using opts.Token bind domain.
+func DomainRecord(ctx context.Context, domain string, opts Options) (name, value string, err error) {
+	if opts.ServerAddr == "" {
+		opts.ServerAddr = DefaultServerAddr
+	}
+	return client.DomainRecord(ctx, client.Config{ServerAddr: opts.ServerAddr, Token: opts.Token}, domain)
+}
+
+type addr string
+
+func (a addr) Network() string { return "openport" }
+func (a addr) String() string  { return string(a) }
@@ -0,0 +1,62 @@
+package openport_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestListen(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	l, err := openport.Listen(context.Background(), openport.Options{ServerAddr: srv.TunnelAddr, Subdomain: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !strings.HasPrefix(l.URL(), "http://app."+openporttest.Domain+":") || l.Addr().String() != l.URL() {
+		t.Fatalf("URL %s, Addr %s", l.URL(), l.Addr())
+	}
+
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	})}
+	served := make(chan error, 1)
+	go func() { served <- hs.Serve(l) }()
+
+	resp, err := srv.HTTPClient().Get(l.URL() + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from /x" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+
+	// Closing the listener ends Serve the way closing a net.Listener does.
+	l.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Serve returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve still running after Close")
+	}
+}
+
+func TestListenUnreachable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := openport.Listen(ctx, openport.Options{ServerAddr: "127.0.0.1:1"}); err == nil {
+		t.Fatal("Listen succeeded without a server")
+	}
+}
@@ -0,0 +1,299 @@
+// Package openporttest runs an openport server and tunnels in-process, for
+// end-to-end tests that need no network access or DNS setup.
+//
+// Tunnels get public URLs such as http://abc123.localhost:PORT. The HTTP
+// client and dialer from Server map every *.localhost name to the loopback
+// interface, so those URLs work as is:
+//
+//	tun := openporttest.Start(t, handler)
+//	resp, err := tun.HTTPClient().Get(tun.URL + "/hello")
+package openporttest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/server"
+	"github.com/nitintf/openport/internal/tunnel"
+)
+
+// Domain is the base domain of the test server. Names under it resolve to
+// the loopback interface through Server.DialContext.
+const Domain = "localhost"
+
+// connectTimeout bounds how long Connect waits for a tunnel to come up.
+const connectTimeout = 10 * time.Second
+
+// ServerConfig and ClientConfig configure the server and its tunnels. Their
+// addresses and domain are filled in by the harness.
+type (
+	ServerConfig = server.Config
+	ClientConfig = client.Config
+)
+
+// Server is an openport server listening on ephemeral loopback ports. It is
+// stopped when the test ends.
+type Server struct {
+	TunnelAddr string // address tunnel clients connect to
+	PublicAddr string // address of the public HTTP listener
+	QUICAddr   string // UDP address tunnel clients connect to over QUIC
+
+	// PassthroughAddr is the address of the TLS passthrough listener, if
+	// ServerConfig.TLSPassthroughAddr was set.
+	PassthroughAddr string
+
+	// AdminAddr is the address of the admin API and metrics, if
+	// ServerConfig.AdminAddr was set.
+	AdminAddr string
+
+	srv    *server.Server
+	client *http.Client
+}
+
+// NewServer starts a server with cfg. Addr, TunnelAddr and Domain are
+// replaced with loopback listeners and Domain, and so are
+// TLSPassthroughAddr and AdminAddr when set.
+func NewServer(tb testing.TB, cfg ServerConfig) *Server {
+	tb.Helper()
+
+	// Listeners opened so far, closed if a later step fails.
+	var opened []io.Closer
+	fail := func(format string, args ...any) {
+		for _, c := range opened {
+			c.Close()
+		}
+		tb.Fatalf("openporttest: "+format, args...)
+	}
+	listen := func(name string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fail("%s listen: %v", name, err)
+		}
+		opened = append(opened, l)
+		return l
+	}
+
+	tunnels := listen("tunnel")
+	public := listen("public")
+	quic, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		fail("quic listen: %v", err)
+	}
+	opened = append(opened, quic)
+
+	var passthrough, admin net.Listener
+	if cfg.TLSPassthroughAddr != "" {
+		passthrough = listen("passthrough")
+		_, port, _ := net.SplitHostPort(passthrough.Addr().String())
+		cfg.TLSPassthroughAddr = ":" + port
+	}
+	if cfg.AdminAddr != "" {
+		admin = listen("admin")
+		cfg.AdminAddr = admin.Addr().String()
+	}
+
+	_, port, _ := net.SplitHostPort(public.Addr().String())
+	cfg.Addr = ":" + port
+	cfg.TunnelAddr = tunnels.Addr().String()
+	cfg.Domain = Domain
+
+	srv, err := server.New(cfg)
+	if err != nil {
+		fail("%v", err)
+	}
+	if passthrough != nil {
+		srv.UsePassthrough(passthrough)
+	}
+	if admin != nil {
+		srv.UseAdmin(admin)
+	}
+
+	s := &Server{
+		TunnelAddr: tunnels.Addr().String(),
+		PublicAddr: public.Addr().String(),
+		QUICAddr:   quic.LocalAddr().String(),
+		srv:        srv,
+	}
+	if passthrough != nil {
+		s.PassthroughAddr = passthrough.Addr().String()
+	}
+	if admin != nil {
+		s.AdminAddr = admin.Addr().String()
+	}
+	s.client = &http.Client{
+		Transport: &http.Transport{DialContext: s.DialContext},
+	}
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := srv.Serve(tunnels, public); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("openporttest: server: %v", err)
+		}
+	}()
+	quicServed := make(chan struct{})
+	go func() {
+		defer close(quicServed)
+		srv.ServeQUIC(quic)
+	}()
+	tb.Cleanup(func() {
+		s.client.CloseIdleConnections()
+		srv.Stop()
+		<-served
+		<-quicServed
+	})
+	return s
+}
+
+// DialContext dials addr, resolving localhost and every name under it to
+// the loopback interface. Other names are dialed as usual.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if isLocalhost(host) {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// WebSocketURL returns the URL at which the server accepts tunnels over a
+// WebSocket, for ClientConfig.ServerURL.
+func (s *Server) WebSocketURL() string {
+	return "ws://" + s.PublicAddr + tunnel.ConnectPath
+}
+
+// HTTPClient returns a client that reaches tunnel URLs through DialContext.
+func (s *Server) HTTPClient() *http.Client {
+	return s.client
+}
+
+// Connect starts a local httptest server for h and opens a tunnel to it
+// with cfg. ServerAddr, unless cfg names a server already, and LocalAddr,
+// when h is not nil, are filled in. With Transport set to QUIC the tunnel
+// goes to QUICAddr, trusting the server's self-signed certificate. It
+// returns once the tunnel is up; the tunnel is closed when the test ends.
+func (s *Server) Connect(tb testing.TB, h http.Handler, cfg ClientConfig) *Tunnel {
+	tb.Helper()
+	tun, err := s.TryConnect(tb, h, cfg)
+	if err != nil {
+		tb.Fatalf("openporttest: tunnel failed: %v", err)
+	}
+	return tun
+}
+
+// TryConnect is like Connect but returns why the tunnel failed to come up,
+// such as a *client.ConnectError from the server, instead of failing the
+// test.
+func (s *Server) TryConnect(tb testing.TB, h http.Handler, cfg ClientConfig) (*Tunnel, error) {
+	tb.Helper()
+
+	tun := &Tunnel{server: s}
+	if h != nil {
+		tun.Local = httptest.NewServer(h)
+		tb.Cleanup(tun.Local.Close)
+		cfg.LocalAddr = tun.Local.Listener.Addr().String()
+	}
+	if cfg.ServerAddr == "" && cfg.ServerURL == "" {
+		cfg.ServerAddr = s.TunnelAddr
+		if cfg.Transport == client.TransportQUIC {
+			cfg.ServerAddr = s.QUICAddr
+			cfg.ServerInsecure = true
+		}
+	}
+
+	c, err := client.New(cfg)
+	if err != nil {
+		tb.Fatalf("openporttest: %v", err)
+	}
+	tun.c = c
+	// Cleanups run last-in first-out, so the tunnel closes before the
+	// local server it forwards to.
+	tb.Cleanup(c.Close)
+
+	if err := c.Start(context.Background()); err != nil {
+		tb.Fatalf("openporttest: %v", err)
+	}
+	select {
+	case <-c.Ready():
+	case <-c.Done():
+		return nil, c.Err()
+	case <-time.After(connectTimeout):
+		tb.Fatalf("openporttest: tunnel not ready after %s", connectTimeout)
+	}
+	tun.URL = c.TunnelURL
+	return tun, nil
+}
+
+// Start starts a server with the default configuration and opens a tunnel
+// to h through it.
+func Start(tb testing.TB, h http.Handler) *Tunnel {
+	tb.Helper()
+	return NewServer(tb, ServerConfig{}).Connect(tb, h, ClientConfig{})
+}
+
+// Tunnel is a connected tunnel client.
+type Tunnel struct {
+	URL   string           // public URL assigned by the server
+	Local *httptest.Server // local service, if Connect started one
+
+	server *Server
+	c      *client.Client
+}
+
+// Server returns the server the tunnel is connected to.
+func (t *Tunnel) Server() *Server {
+	return t.server
+}
+
+// HTTPClient returns the server's client for reaching the tunnel URL.
+func (t *Tunnel) HTTPClient() *http.Client {
+	return t.server.client
+}
+
+// Host returns the public host of the tunnel, e.g. abc123.localhost:PORT.
+func (t *Tunnel) Host() string {
+	return strings.TrimPrefix(t.URL, "http://")
+}
+
+// CompressionRatio reports how well response bodies compressed on their way
+// through the tunnel, or 0 if none were compressed.
+func (t *Tunnel) CompressionRatio() float64 {
+	return t.c.CompressionRatio()
+}
+
+// Close drops the tunnel at once, as if the client had lost its connection.
+func (t *Tunnel) Close() {
+	t.c.Close()
+}
+
+// Shutdown closes the tunnel after the requests in flight finish.
+func (t *Tunnel) Shutdown(ctx context.Context) error {
+	return t.c.Shutdown(ctx)
+}
+
+// Done is closed when the tunnel has ended; Err then says why.
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.c.Done()
+}
+
+// Err returns why the tunnel ended, or nil while it is running.
+func (t *Tunnel) Err() error {
+	return t.c.Err()
+}
+
+func isLocalhost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host == Domain || strings.HasSuffix(host, "."+Domain)
+}
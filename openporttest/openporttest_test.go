@@ -0,0 +1,812 @@
+package openporttest_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/nitintf/openport/internal/client"
+	"github.com/nitintf/openport/internal/tunnel"
+	"github.com/nitintf/openport/openporttest"
+)
+
+func TestHTTP(t *testing.T) {
+	tun := openporttest.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s host=%s", r.Method, r.URL.Path, body, r.Header.Get("X-Forwarded-Host"))
+	}))
+
+	resp, err := tun.HTTPClient().Post(tun.URL+"/echo", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+
+	want := "POST /echo hi host=" + tun.Host()
+	if resp.StatusCode != http.StatusOK || string(got) != want {
+		t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, got, want)
+	}
+}
+
+func TestUnknownSubdomain(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+
+	_, port, _ := net.SplitHostPort(srv.PublicAddr)
+	resp, err := srv.HTTPClient().Get("http://missing." + openporttest.Domain + ":" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	tun := openporttest.Start(t, websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+
+	cfg, err := websocket.NewConfig("ws://"+tun.Host()+"/ws", tun.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tun.Server().DialContext(context.Background(), "tcp", tun.Host())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != msg {
+			t.Fatalf("got %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	t.Run("plain", func(t *testing.T) { testStreaming(t, openporttest.ClientConfig{}) })
+	t.Run("compressed", func(t *testing.T) { testStreaming(t, openporttest.ClientConfig{Compress: true}) })
+}
+
+func testStreaming(t *testing.T, cfg openporttest.ClientConfig) {
+	next := make(chan struct{})
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range 3 {
+			fmt.Fprintf(w, "data: %d\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}), cfg)
+
+	resp, err := tun.HTTPClient().Get(tun.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Each event must arrive before the handler is allowed to send the
+	// next, so nothing along the way may buffer the body.
+	r := bufio.NewReader(resp.Body)
+	for i := range 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("data: %d\n", i); line != want {
+			t.Fatalf("got %q, want %q", line, want)
+		}
+		next <- struct{}{}
+	}
+}
+
+func TestStreamingVisitorGone(t *testing.T) {
+	for name, cfg := range map[string]openporttest.ClientConfig{
+		"tcp":  {},
+		"quic": {Transport: "quic"},
+	} {
+		t.Run(name, func(t *testing.T) { testStreamingVisitorGone(t, cfg) })
+	}
+}
+
+func testStreamingVisitorGone(t *testing.T, cfg openporttest.ClientConfig) {
+	stopped := make(chan struct{})
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(stopped)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			io.WriteString(w, "data: tick\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}), cfg)
+
+	resp, err := tun.HTTPClient().Get(tun.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The endless stream must end with the visitor, not run on in the
+	// tunnel and the local service.
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local service still streaming after the visitor left")
+	}
+}
+
+// TestGRPC streams a request and response at once over HTTP/2 at both ends,
+// the way gRPC does, and checks that the trailer comes through.
+func TestGRPC(t *testing.T) {
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "not gRPC", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// Echo each message as it comes, before the request ends.
+		buf := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r.Body, buf); err != nil {
+				break
+			}
+			w.Write(buf)
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	local.Config.Protocols = new(http.Protocols)
+	local.Config.Protocols.SetUnencryptedHTTP2(true)
+	local.Start()
+	defer local.Close()
+
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	tun := srv.Connect(t, nil, openporttest.ClientConfig{
+		LocalAddr:  local.Listener.Addr().String(),
+		LocalHTTP2: true,
+	})
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	visitor := &http.Client{Transport: &http.Transport{DialContext: srv.DialContext, Protocols: h2c}}
+	defer visitor.CloseIdleConnections()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, tun.URL+"/echo.Echo/Stream", pr)
+	req.Header.Set("Content-Type", "application/grpc")
+	respc := make(chan *http.Response, 1)
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := visitor.Do(req)
+		if err != nil {
+			errc <- err
+			return
+		}
+		respc <- resp
+	}()
+
+	io.WriteString(pw, "ping")
+	var resp *http.Response
+	select {
+	case resp = <-respc:
+	case err := <-errc:
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("got %s %d, want HTTP/2 200", resp.Proto, resp.StatusCode)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, %v before the request ended, want the echo", buf, err)
+	}
+
+	pw.Close()
+	if rest, err := io.ReadAll(resp.Body); err != nil || len(rest) != 0 {
+		t.Fatalf("after the request ended: got %q, %v", rest, err)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Fatalf("got Grpc-Status trailer %q, want 0", got)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1000)
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Openport-Encoding") != "" || r.ContentLength != int64(len(body)) || string(body) != text {
+			http.Error(w, "request body mangled", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", fmt.Sprint(len(text)))
+		io.WriteString(w, text)
+	}), openporttest.ClientConfig{Compress: true})
+
+	resp, err := tun.HTTPClient().Post(tun.URL+"/", "text/plain", strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(got) != text {
+		t.Fatalf("got %d with %d bytes, want 200 with %d", resp.StatusCode, len(got), len(text))
+	}
+	// Compression is private to the tunnel: the visitor sees the
+	// response as the local service sent it.
+	if resp.ContentLength != int64(len(text)) {
+		t.Fatalf("got Content-Length %d, want %d", resp.ContentLength, len(text))
+	}
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "Openport-") {
+			t.Fatalf("tunnel header %s leaked to the visitor", k)
+		}
+	}
+	if ratio := tun.CompressionRatio(); ratio < 10 {
+		t.Fatalf("compression ratio %.1f, want the response compressed", ratio)
+	}
+}
+
+// TestCompressionHeadersFromVisitor sends a gzip bomb marked the way the
+// tunnel marks compressed bodies. It must reach the local service as sent.
+func TestCompressionHeadersFromVisitor(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, 10<<20))
+	zw.Close()
+
+	for name, cfg := range map[string]openporttest.ClientConfig{
+		"plain":      {},
+		"compressed": {Compress: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := openporttest.NewServer(t, openporttest.ServerConfig{MaxRequestBody: 100000})
+			tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				fmt.Fprintf(w, "%d %q", len(body), r.Header.Get("Openport-Encoding"))
+			}), cfg)
+
+			req, _ := http.NewRequest(http.MethodPost, tun.URL, bytes.NewReader(bomb.Bytes()))
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Openport-Encoding", "gzip")
+			req.Header.Set("Openport-Length", "10485760")
+			resp, err := tun.HTTPClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if want := fmt.Sprintf("%d %q", bomb.Len(), ""); string(got) != want {
+				t.Fatalf("local service got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+
+	for name, cfg := range map[string]openporttest.ClientConfig{
+		"only": {ServerURL: srv.WebSocketURL()},
+		// Nothing listens on port 1, so the WebSocket takes over.
+		"fallback": {ServerAddr: "127.0.0.1:1", ServerURL: srv.WebSocketURL()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tun := srv.Connect(t, hello, cfg)
+			if status := get(t, srv.HTTPClient(), tun.URL); status != http.StatusOK {
+				t.Fatalf("got %d through the WebSocket tunnel, want 200", status)
+			}
+		})
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	big := strings.Repeat("0123456789abcdef", 1<<16)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, big)
+	})
+	tun := srv.Connect(t, mux, openporttest.ClientConfig{Transport: "quic"})
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := srv.HTTPClient().Get(tun.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	<-started
+
+	// The stalled request has a stream of its own and holds nothing up.
+	resp, err := srv.HTTPClient().Get(tun.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != big {
+		t.Fatalf("got %d bytes, %v; want %d bytes", len(body), err, len(big))
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- tun.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-slow; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+}
+
+func TestE2E(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{TLSPassthroughAddr: ":0"})
+	certFile, keyFile, roots := testCertificate(t, "secure."+openporttest.Domain)
+	var hits atomic.Int32
+	tun := srv.Connect(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Forwarded-Proto"), r.URL.Path)
+	}), openporttest.ClientConfig{
+		Subdomain: "secure",
+		E2E:       true,
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+	})
+	_, port, _ := net.SplitHostPort(srv.PassthroughAddr)
+	if want := "https://secure." + openporttest.Domain + ":" + port; tun.URL != want {
+		t.Fatalf("tunnel URL %s, want %s", tun.URL, want)
+	}
+
+	visitor := &http.Client{Transport: &http.Transport{
+		DialContext:       srv.DialContext,
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	defer visitor.CloseIdleConnections()
+	resp, err := visitor.Get(tun.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "https /hello" || resp.ProtoMajor != 2 {
+		t.Fatalf("got %s %d %q, want HTTP/2 200 %q", resp.Proto, resp.StatusCode, body, "https /hello")
+	}
+
+	// Plain HTTP never reaches the local service: visitors are sent to the
+	// https URL, and only ACME challenges are passed to op, which has none
+	// to answer with a certificate of its own.
+	plain := &http.Client{
+		Transport:     srv.HTTPClient().Transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	_, port, _ = net.SplitHostPort(srv.PublicAddr)
+	host := "http://secure." + openporttest.Domain + ":" + port
+	for path, want := range map[string]int{
+		"/hello?x=1":                          http.StatusPermanentRedirect,
+		"/.well-known/acme-challenge/unknown": http.StatusNotFound,
+	} {
+		resp, err := plain.Get(host + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+		if want == http.StatusPermanentRedirect && resp.Header.Get("Location") != tun.URL+path {
+			t.Errorf("GET %s: redirected to %s, want %s", path, resp.Header.Get("Location"), tun.URL+path)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("local service saw %d requests, want 1", n)
+	}
+}
+
+// testCertificate writes a certificate for host, signed by a new CA, and its
+// key to files, returning their paths and a pool trusting the CA.
+func testCertificate(t *testing.T, host string) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "openporttest CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	roots = x509.NewCertPool()
+	roots.AddCert(ca)
+	return certFile, keyFile, roots
+}
+
+func TestUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	port := freeUDPPort(t)
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{UDPPortStart: port, UDPPortEnd: port})
+	cfg := openporttest.ClientConfig{Type: "udp", LocalAddr: echo.LocalAddr().String()}
+	tun := srv.Connect(t, nil, cfg)
+	if want := fmt.Sprintf("udp://%s:%d", openporttest.Domain, port); tun.URL != want {
+		t.Fatalf("tunnel URL %s, want %s", tun.URL, want)
+	}
+
+	// Each peer gets its own replies.
+	for _, msg := range []string{"one", "two"} {
+		peer, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		peer.SetDeadline(time.Now().Add(5 * time.Second))
+		peer.Write([]byte(msg))
+		buf := make([]byte, 64)
+		n, err := peer.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("got %q, %v; want the echo of %q", buf[:n], err, msg)
+		}
+	}
+
+	// The only port is taken, which is no fault of the number of tunnels.
+	if _, err := srv.TryConnect(t, nil, cfg); !errors.Is(err, client.ErrPortsExhausted) {
+		t.Fatalf("second tunnel: got %v, want ErrPortsExhausted", err)
+	}
+}
+
+// freeUDPPort returns a UDP port that was free a moment ago.
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+// txtRecords is a Resolver serving fixed TXT records, counting lookups.
+type txtRecords struct {
+	records map[string][]string
+	lookups atomic.Int32
+}
+
+func (r *txtRecords) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	r.lookups.Add(1)
+	if txt, ok := r.records[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestCustomDomains(t *testing.T) {
+	const token, key = "secret", "domain key"
+	value := tunnel.DomainVerification([]byte(key), token, "app.example.test")
+	resolver := &txtRecords{records: map[string][]string{"_openport.app.example.test": {value}}}
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{
+		AuthTokens:    []string{token},
+		CustomDomains: true,
+		Resolver:      resolver,
+		DomainKey:     key,
+	})
+
+	// The value depends on the key as well as the token, so only the
+	// server can say what it is.
+	if value == tunnel.DomainVerification(nil, token, "app.example.test") {
+		t.Fatal("the TXT value does not depend on the key")
+	}
+	if value == tunnel.DomainVerification([]byte(key), token, "other.example.test") {
+		t.Fatal("the TXT value does not depend on the domain")
+	}
+	name, got, err := client.DomainRecord(context.Background(), openporttest.ClientConfig{ServerAddr: srv.TunnelAddr, Token: token}, "app.example.test")
+	if err != nil || name != "_openport.app.example.test" || got != value {
+		t.Fatalf("DomainRecord = %q, %q, %v, want _openport.app.example.test, %q", name, got, err, value)
+	}
+	if _, _, err := client.DomainRecord(context.Background(), openporttest.ClientConfig{ServerAddr: srv.TunnelAddr, Token: "guess"}, "app.example.test"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("DomainRecord with a bad token: got %v, want ErrUnauthorized", err)
+	}
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	})
+
+	srv.Connect(t, hello, openporttest.ClientConfig{
+		Token:   token,
+		Domains: []string{"App.Example.Test"},
+	})
+	req, _ := http.NewRequest(http.MethodGet, "http://"+srv.PublicAddr+"/", nil)
+	req.Host = "app.example.test"
+	resp, err := srv.HTTPClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from app.example.test" {
+		t.Fatalf("through the custom domain: got %d %q", resp.StatusCode, body)
+	}
+
+	for name, tc := range map[string]struct {
+		cfg     openporttest.ClientConfig
+		want    error
+		lookups bool
+	}{
+		"missing TXT record": {
+			cfg:     openporttest.ClientConfig{Token: token, Domains: []string{"other.example.test"}},
+			want:    client.ErrDomainUnverified,
+			lookups: true,
+		},
+		"taken": {
+			cfg:     openporttest.ClientConfig{Token: token, Domains: []string{"app.example.test"}},
+			want:    client.ErrDomainTaken,
+			lookups: true,
+		},
+		"bad token": {
+			cfg:  openporttest.ClientConfig{Token: "guess", Domains: []string{"app.example.test"}},
+			want: client.ErrUnauthorized,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			before := resolver.lookups.Load()
+			_, err := srv.TryConnect(t, hello, tc.cfg)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+			if looked := resolver.lookups.Load() > before; looked != tc.lookups {
+				t.Fatalf("looked up TXT records: %v, want %v", looked, tc.lookups)
+			}
+		})
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	srv := openporttest.NewServer(t, openporttest.ServerConfig{})
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	cfg := openporttest.ClientConfig{Subdomain: "app"}
+
+	tun := srv.Connect(t, hello, cfg)
+	url := tun.URL
+	if status := get(t, srv.HTTPClient(), url); status != http.StatusOK {
+		t.Fatalf("before disconnect: got %d, want 200", status)
+	}
+
+	tun.Close()
+	<-tun.Done()
+	waitFor(t, func() bool {
+		return get(t, srv.HTTPClient(), url) == http.StatusNotFound
+	})
+
+	tun = srv.Connect(t, hello, cfg)
+	if tun.URL != url {
+		t.Fatalf("reconnected as %s, want %s", tun.URL, url)
+	}
+	if status := get(t, srv.HTTPClient(), url); status != http.StatusOK {
+		t.Fatalf("after reconnect: got %d, want 200", status)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	tun := openporttest.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		resp, err := tun.HTTPClient().Get(tun.URL)
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		res <- result{string(body), err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- tun.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	r := <-res
+	if r.err != nil || r.body != "done" {
+		t.Fatalf("in-flight request: got %q, %v", r.body, r.err)
+	}
+}
+
+func get(t *testing.T, c *http.Client, url string) int {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func BenchmarkSmallRequest(b *testing.B) {
+	tun := openporttest.Start(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	hc := tun.HTTPClient()
+	hc.Transport.(*http.Transport).MaxIdleConnsPerHost = 64
+
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := hc.Get(tun.URL)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
+
+func BenchmarkLargeUpload(b *testing.B) {
+	tun := openporttest.Start(b, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+	hc := tun.HTTPClient()
+	body := make([]byte, 8<<20)
+
+	b.SetBytes(int64(len(body)))
+	for b.Loop() {
+		resp, err := hc.Post(tun.URL, "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}